@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+var migrationLockTimeout = flag.Duration("migration-lock-timeout", 0, "how long fly waits for another migration in progress to finish (0 means forever)")
+
+// migrationLock takes a session-level advisory lock that keeps other fly
+// processes from changing the migrations of the same schema at the same time,
+// and returns the function that releases it. The key is derived from the
+// qualified name of the migration table. The wait is bounded by
+// -migration-lock-timeout, and ends when ctx is cancelled. Advisory locks only
+// exist in Postgres: with other drivers nothing is locked.
+func migrationLock(ctx context.Context, db *sql.DB, table string) (release func(), err error) {
+	if *driver != "postgres" {
+		return func() {}, nil
+	}
+	// The migrations would wait forever for the connection the lock holds.
+	if *maxOpenConns == 1 {
+		return nil, errors.New("the migration lock takes a connection of its own: -max-open-conns must be 0 or at least 2")
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	schema, name := splitTable(table)
+	qualifier := "current_schema()"
+	if schema != "" {
+		qualifier = pq.QuoteLiteral(schema)
+	}
+	key := "hashtext(" + qualifier + " || '.' || " + pq.QuoteLiteral(name) + ")"
+	if *migrationLockTimeout > 0 {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET lock_timeout = %d", migrationLockTimeout.Milliseconds())); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	verbosef("waiting for the migration lock")
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock("+key+")"); err != nil {
+		conn.Close()
+		var perr *pq.Error
+		if errors.As(err, &perr) && perr.Code == "55P03" {
+			return nil, errors.New("another migration is in progress")
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("could not lock migrations: %v", err)
+	}
+	if *migrationLockTimeout > 0 {
+		conn.ExecContext(ctx, "RESET lock_timeout")
+	}
+	verbosef("took the migration lock")
+	return func() {
+		// The lock outlives an interrupted command, and must be released
+		// before the connection goes back to the pool.
+		verbosef("releasing the migration lock")
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock("+key+")")
+		conn.Close()
+	}, nil
+}
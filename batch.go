@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// batch describes how a batched migration walks its table: in ranges of size
+// values of the integer column key of table.
+type batch struct {
+	size       int64
+	table, key string
+}
+
+// batchOf returns the batch described by the fly:batch-size and fly:batch-key
+// directives of the up script of the migration, and whether it has them.
+func batchOf(fsys fs.FS, migration string) (batch, bool, error) {
+	script, err := fs.ReadFile(fsys, migration+".up.sql")
+	if err != nil {
+		return batch{}, false, err
+	}
+	d := directives(string(script))
+	size, hasSize := d["batch-size"]
+	key, hasKey := d["batch-key"]
+	if !hasSize && !hasKey {
+		return batch{}, false, nil
+	}
+	if *driver != "postgres" {
+		return batch{}, false, fmt.Errorf("cannot run %s: batched migrations need the postgres driver", migration)
+	}
+
+	var b batch
+	b.size, err = strconv.ParseInt(size, 10, 64)
+	if err != nil || b.size <= 0 {
+		return batch{}, false, fmt.Errorf("invalid fly:batch-size in %s: want a positive number", migration)
+	}
+	// The table may be qualified with its schema: the column comes after the last dot.
+	i := strings.LastIndex(key, ".")
+	if i < 0 {
+		return batch{}, false, fmt.Errorf("invalid fly:batch-key in %s: want table.column", migration)
+	}
+	b.table, b.key = key[:i], key[i+1:]
+	if b.key == "" || slices.Contains(strings.Split(b.table, "."), "") || strings.Count(b.table, ".") > 1 {
+		return batch{}, false, fmt.Errorf("invalid fly:batch-key in %s: want table.column", migration)
+	}
+	return b, true, nil
+}
+
+// quoteTable quotes a table name, optionally qualified with its schema.
+func quoteTable(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = pq.QuoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// applyBatched runs the single statement of the up script of the migration
+// once per range of the batch key, from its lowest to its highest value, each
+// in a transaction of its own. The statement receives the range as $1
+// (inclusive) and $2 (exclusive). The start of the next range is
+// checkpointed with each batch, so that running up again after a failure
+// resumes from the failed batch.
+func applyBatched(ctx context.Context, db *sql.DB, fsys fs.FS, table, migration string, b batch) error {
+	began := time.Now()
+	filename := migration + ".up.sql"
+	script, err := readScript(fsys, filename)
+	if err != nil {
+		return err
+	}
+	stmts := splitStatements(string(script))
+	if len(stmts) != 1 {
+		return fmt.Errorf("batched migration %s must have exactly one statement, it has %d", migration, len(stmts))
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var low, high sql.NullInt64
+	query := fmt.Sprintf("SELECT min(%[1]s), max(%[1]s) FROM %[2]s", pq.QuoteIdentifier(b.key), quoteTable(b.table))
+	if err := conn.QueryRowContext(ctx, query).Scan(&low, &high); err != nil {
+		return fmt.Errorf("could not read the range of %s.%s: %v", b.table, b.key, err)
+	}
+
+	if err := initProgressTable(conn, table); err != nil {
+		return err
+	}
+	start, resumed, err := readProgress(conn, table, migration)
+	if err != nil {
+		return err
+	}
+	if resumed {
+		log.Printf("resuming %s from %s %d", migration, b.key, start)
+	} else {
+		start = low.Int64
+	}
+
+	role := *execRole
+	if r, ok := directives(string(script))["role"]; ok {
+		role = r
+	}
+	for ; high.Valid && start <= high.Int64; start += b.size {
+		err := func() error {
+			verbosef("%s: batch from %d to %d", filename, start, start+b.size)
+			tx, err := conn.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if role != "" {
+				if _, err := tx.ExecContext(ctx, "SET LOCAL ROLE "+pq.QuoteIdentifier(role)); err != nil {
+					return fmt.Errorf("could not run %s as %s: %v", filename, role, err)
+				}
+			}
+			if _, err := tx.ExecContext(ctx, stmts[0], start, start+b.size); err != nil {
+				return fmt.Errorf("could not run %s: batch from %d: %v", filename, start, err)
+			}
+			if role != "" {
+				if _, err := tx.ExecContext(ctx, "RESET ROLE"); err != nil {
+					return err
+				}
+			}
+			if err := saveProgress(tx, table, migration, start+b.size); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	return finishProgress(conn, fsys, table, migration, time.Since(began))
+}
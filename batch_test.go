@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestBatchOf(t *testing.T) {
+	tests := []struct {
+		name, script string
+		want         batch
+		batched, ok  bool
+	}{
+		{"not batched", "UPDATE users SET x = 1;", batch{}, false, true},
+		{"table and column", "-- fly:batch-size 1000\n-- fly:batch-key users.id\nUPDATE users SET x = 1 WHERE id >= $1 AND id < $2;", batch{1000, "users", "id"}, true, true},
+		{"schema-qualified table", "-- fly:batch-size 50\n-- fly:batch-key app.users.id\nSELECT 1;", batch{50, "app.users", "id"}, true, true},
+		{"no column", "-- fly:batch-size 50\n-- fly:batch-key users\nSELECT 1;", batch{}, false, false},
+		{"empty column", "-- fly:batch-size 50\n-- fly:batch-key users.\nSELECT 1;", batch{}, false, false},
+		{"empty table", "-- fly:batch-size 50\n-- fly:batch-key .id\nSELECT 1;", batch{}, false, false},
+		{"empty schema", "-- fly:batch-size 50\n-- fly:batch-key .users.id\nSELECT 1;", batch{}, false, false},
+		{"too many dots", "-- fly:batch-size 50\n-- fly:batch-key db.app.users.id\nSELECT 1;", batch{}, false, false},
+		{"no size", "-- fly:batch-key users.id\nSELECT 1;", batch{}, false, false},
+		{"negative size", "-- fly:batch-size -5\n-- fly:batch-key users.id\nSELECT 1;", batch{}, false, false},
+	}
+	defer func(d string) { *driver = d }(*driver)
+	*driver = "postgres"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"0001_x.up.sql": {Data: []byte(tt.script)}}
+			b, batched, err := batchOf(fsys, "0001_x")
+			if (err == nil) != tt.ok {
+				t.Fatalf("batchOf: error %v, want ok %v", err, tt.ok)
+			}
+			if b != tt.want || batched != tt.batched {
+				t.Errorf("batchOf = %+v, %v, want %+v, %v", b, batched, tt.want, tt.batched)
+			}
+		})
+	}
+}
+
+func TestQuoteTable(t *testing.T) {
+	tests := map[string]string{
+		"users":     `"users"`,
+		"app.users": `"app"."users"`,
+		`we"ird`:    `"we""ird"`,
+	}
+	for name, want := range tests {
+		if got := quoteTable(name); got != want {
+			t.Errorf("quoteTable(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+func doCompletion() error {
+	switch shell := flag.Arg(1); shell {
+	case "bash":
+		printBashCompletion()
+	case "zsh":
+		printZshCompletion()
+	case "fish":
+		printFishCompletion()
+	case "":
+		return errors.New("usage: fly completion bash|zsh|fish")
+	default:
+		return fmt.Errorf("unsupported shell %q: want bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+// flagUsage returns the usage message of f, without the name of its argument.
+func flagUsage(f *flag.Flag) string {
+	_, usage := flag.UnquoteUsage(f)
+	return usage
+}
+
+func printBashCompletion() {
+	var names, flags []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "-"+f.Name)
+	})
+
+	fmt.Printf(`_fly() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	elif [[ $COMP_CWORD -eq 1 ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	fi
+}
+complete -o default -F _fly fly
+`, strings.Join(flags, " "), strings.Join(names, " "))
+}
+
+func printZshCompletion() {
+	escape := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`).Replace
+
+	fmt.Println("#compdef fly")
+	fmt.Println()
+	fmt.Println("local -a commands")
+	fmt.Println("commands=(")
+	for _, c := range commands {
+		fmt.Printf("\t'%s:%s'\n", c.name, escape(c.summary))
+	}
+	fmt.Println(")")
+	fmt.Println()
+	fmt.Println("_arguments \\")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Printf("\t'-%s[%s]' \\\n", f.Name, escape(flagUsage(f)))
+	})
+	fmt.Println("\t'1:command:->command' \\")
+	fmt.Println("\t'*:file:_files'")
+	fmt.Println()
+	fmt.Println(`[[ $state == command ]] && _describe command commands`)
+}
+
+func printFishCompletion() {
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace
+
+	fmt.Println("complete -c fly -f")
+	for _, c := range commands {
+		fmt.Printf("complete -c fly -n __fish_use_subcommand -a %s -d '%s'\n", c.name, escape(c.summary))
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Printf("complete -c fly -o %s -d '%s'\n", f.Name, escape(flagUsage(f)))
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var configFile = flag.String("config", "fly.toml", "configuration `file`; missing is fine unless given explicitly")
+
+// configDSN is the connection string read from the configuration file.
+var configDSN string
+
+// loadConfig reads the configuration file. It holds "key = value" lines, a
+// small subset of TOML: the dsn key is the connection string, used when
+// neither -dsn nor the environment give one, and any other key is the name of
+// a flag. Flags given on the command line take precedence over the file.
+func loadConfig() error {
+	f, err := os.Open(*configFile)
+	if errors.Is(err, fs.ErrNotExist) && !isFlagSet("config") {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read config: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", *configFile, n)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s:%d: bad string for %s", *configFile, n, key)
+			}
+		}
+
+		switch {
+		case key == "dsn":
+			configDSN = value
+		case flag.Lookup(key) == nil:
+			return fmt.Errorf("%s:%d: unknown key %s", *configFile, n, key)
+		case !isFlagSet(key):
+			if err := flag.Set(key, value); err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q for %s: %v", *configFile, n, value, key, err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// isFlagSet reports whether the flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// ask prompts for a value on the terminal, offering a default for an empty answer.
+func ask(question, def string) (string, error) {
+	if def != "" {
+		question += " [" + def + "]"
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", question)
+	answer, err := stdin.ReadString('\n')
+	if err != nil && answer == "" {
+		return "", err
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// keywordDSN builds a key/value connection string from its parameters,
+// leaving out the empty ones.
+func keywordDSN(params [][2]string) string {
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	var parts []string
+	for _, p := range params {
+		if p[1] != "" {
+			parts = append(parts, p[0]+"='"+quote.Replace(p[1])+"'")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func doSetup() error {
+	if !interactive() {
+		return errors.New("setup must be run from a terminal")
+	}
+	if _, err := os.Stat(*configFile); err == nil {
+		ok, err := confirm(context.Background(), *configFile+" exists. Overwrite it?")
+		if err != nil || !ok {
+			return errors.New("setup cancelled")
+		}
+	}
+
+	params := [][2]string{
+		{"host", "localhost"},
+		{"port", "5432"},
+		{"user", os.Getenv("USER")},
+		{"password", ""},
+		{"dbname", ""},
+		{"sslmode", "require"},
+	}
+	for i, p := range params {
+		question := p[0]
+		switch p[0] {
+		case "password":
+			question += " (shown as typed)"
+		case "sslmode":
+			question += " (disable, require, verify-ca or verify-full)"
+		}
+		value, err := ask(question, p[1])
+		if err != nil {
+			return err
+		}
+		params[i][1] = value
+	}
+	dsn := keywordDSN(params)
+
+	db, err := connect(dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("could not connect: %v", err)
+	}
+
+	config := "# Written by fly setup.\ndsn = " + strconv.Quote(dsn) + "\n"
+	if err := os.WriteFile(*configFile, []byte(config), 0600); err != nil {
+		return err
+	}
+	fmt.Println("wrote", *configFile)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// configFlags replaces the command line flags with a few of fly's, parsed from
+// args, for the duration of the test.
+func configFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	previous, previousDSN := flag.CommandLine, configDSN
+	t.Cleanup(func() { flag.CommandLine, configDSN = previous, previousDSN })
+	configDSN = ""
+
+	fs := flag.NewFlagSet("fly", flag.ContinueOnError)
+	fs.StringVar(configFile, "config", "fly.toml", "")
+	fs.StringVar(dsn, "dsn", "", "")
+	fs.StringVar(dsnEnv, "dsn-env", "DATABASE_URL", "")
+	fs.String("table", "migration", "")
+	fs.Duration("timeout", 0, "")
+	fs.Bool("verbose", false, "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	flag.CommandLine = fs
+	return fs
+}
+
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "fly.toml")
+	if err := os.WriteFile(name, []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   map[string]string
+		dsn    string
+		err    string
+	}{
+		{
+			name:   "values",
+			config: "# Written by hand.\n\ndsn = \"postgres://localhost/app\"\ntable=fly_migration\n  timeout =  5s  \nverbose = true\n",
+			want:   map[string]string{"table": "fly_migration", "timeout": "5s", "verbose": "true"},
+			dsn:    "postgres://localhost/app",
+		},
+		{
+			name:   "quoted",
+			config: `table = "a \"quoted\" name"` + "\n" + `dsn = "host='db' password='a=b'"`,
+			want:   map[string]string{"table": `a "quoted" name`},
+			dsn:    "host='db' password='a=b'",
+		},
+		{
+			name:   "command line first",
+			config: "table = from_config\ntimeout = 5s\n",
+			args:   []string{"-table", "from_flag"},
+			want:   map[string]string{"table": "from_flag", "timeout": "5s"},
+		},
+		{
+			name:   "empty",
+			config: "",
+			want:   map[string]string{"table": "migration", "timeout": "0s"},
+		},
+		{
+			name:   "unknown key",
+			config: "table = x\ntabel = y\n",
+			err:    ":2: unknown key tabel",
+		},
+		{
+			name:   "not a key",
+			config: "[fly]\ntable = x\n",
+			err:    ":1: expected key = value",
+		},
+		{
+			name:   "bad string",
+			config: `dsn = "unterminated`,
+			err:    ":1: bad string for dsn",
+		},
+		{
+			name:   "bad value",
+			config: "timeout = soon\n",
+			err:    `:1: invalid value "soon" for timeout`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := writeConfig(t, tt.config)
+			fs := configFlags(t, append([]string{"-config", name}, tt.args...)...)
+
+			err := loadConfig()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("loadConfig = %v, want error %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tt.want {
+				if got := fs.Lookup(key).Value.String(); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+			if configDSN != tt.dsn {
+				t.Errorf("dsn = %q, want %q", configDSN, tt.dsn)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	configFlags(t)
+	if err := loadConfig(); err != nil {
+		t.Errorf("loadConfig without fly.toml: %v", err)
+	}
+
+	configFlags(t, "-config", filepath.Join(dir, "other.toml"))
+	if err := loadConfig(); err == nil {
+		t.Error("loadConfig accepted a missing file given with -config")
+	}
+}
+
+func TestTargetDSN(t *testing.T) {
+	config := writeConfig(t, `dsn = "from_config"`)
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"config", nil, nil, "from_config"},
+		{"environment", nil, map[string]string{"DATABASE_URL": "from_env"}, "from_env"},
+		{"fly environment", nil, map[string]string{"DATABASE_URL": "from_env", "FLY_DATABASE_URL": "from_fly_env"}, "from_fly_env"},
+		{"dsn-env", []string{"-dsn-env", "APP_DB"}, map[string]string{"DATABASE_URL": "from_env", "APP_DB": "from_app_env"}, "from_app_env"},
+		{"dsn-env unset", []string{"-dsn-env", "APP_DB"}, map[string]string{"DATABASE_URL": "from_env"}, "from_config"},
+		{"flag", []string{"-dsn", "from_flag"}, map[string]string{"FLY_DATABASE_URL": "from_fly_env"}, "from_flag"},
+		{"empty flag", []string{"-dsn="}, map[string]string{"FLY_DATABASE_URL": "from_fly_env"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"FLY_DATABASE_URL", "DATABASE_URL", "APP_DB"} {
+				if value, ok := tt.env[name]; ok {
+					t.Setenv(name, value)
+				} else {
+					t.Setenv(name, "")
+					os.Unsetenv(name)
+				}
+			}
+			configFlags(t, append([]string{"-config", config}, tt.args...)...)
+			if err := loadConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if got := targetDSN(); got != tt.want {
+				t.Errorf("targetDSN = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
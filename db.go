@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	migrationTable  = flag.String("table", "migration", "`name` of the migration table, optionally schema-qualified")
+	dsn             = flag.String("dsn", "", "connection `string` of the database, taking precedence over the environment; -dsn= uses the PG* variables")
+	dsnEnv          = flag.String("dsn-env", "DATABASE_URL", "environment `variable` holding the connection string")
+	maxOpenConns    = flag.Int("max-open-conns", 0, "maximum number of open database connections (0 means unlimited)")
+	maxIdleConns    = flag.Int("max-idle-conns", 2, "maximum number of idle database connections")
+	connMaxLifetime = flag.Duration("conn-max-lifetime", 0, "maximum time a database connection may be reused (0 means forever)")
+	schemaName      = flag.String("schema", "", "Postgres `schema` to work in: the search path of every connection, where the migration table and the scripts' objects go")
+	connectTimeout  = flag.Duration("connect-timeout", 0, "how long to wait for the database to accept connections (0 means not at all)")
+)
+
+// targetDSN returns the connection string of the database that fly manages:
+// the -dsn flag, or else the FLY_DATABASE_URL variable, the -dsn-env variable
+// or the dsn of the configuration file, whichever comes first. An empty string
+// leaves the connection parameters to the PG* environment variables.
+func targetDSN() string {
+	if isFlagSet("dsn") {
+		return *dsn
+	}
+	for _, name := range []string{"FLY_DATABASE_URL", *dsnEnv} {
+		if dsn, ok := os.LookupEnv(name); ok {
+			return dsn
+		}
+	}
+	return configDSN
+}
+
+// openDB opens the database that fly manages, waiting for it up to
+// -connect-timeout.
+func openDB() (*sql.DB, error) {
+	dsn := targetDSN()
+	if *schemaName != "" {
+		if *driver != "postgres" {
+			return nil, errors.New("-schema needs the postgres driver")
+		}
+		if !identPattern.MatchString(*schemaName) {
+			return nil, fmt.Errorf("invalid -schema %q: want letters, digits and underscores", *schemaName)
+		}
+		// A run-time parameter rather than SET search_path, so that
+		// every connection of the pool gets it.
+		dsn = withSearchPath(dsn, *schemaName)
+	}
+	db, err := connect(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if *connectTimeout > 0 {
+		if err := waitForDB(db, *connectTimeout); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// waitForDB pings the database until it answers, for databases that start
+// along with fly. It waits twice as long after each failed attempt, up to 5s,
+// and gives up after timeout or when fly is interrupted.
+func waitForDB(db *sql.DB, timeout time.Duration) error {
+	ctx, stop := interruptible()
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastErr error
+	for delay := 100 * time.Millisecond; ; delay = min(2*delay, 5*time.Second) {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() == nil {
+			lastErr = err
+		}
+		verbosef("database not reachable, retrying in %v: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("database not reachable after %v: %v", timeout, lastErr)
+			}
+			return &exitError{130, "interrupted while waiting for the database"}
+		}
+	}
+}
+
+// withDB adapts a command that works on the database fly manages, so that the
+// database is opened once, before the command runs, and closed after it.
+func withDB(run func(db *sql.DB) error) func() error {
+	return func() error {
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return run(db)
+	}
+}
+
+// withShadowDB is withDB for commands that work on the -shadow-dsn database.
+func withShadowDB(run func(db *sql.DB) error) func() error {
+	return func() error {
+		db, err := connect(*shadowDSN)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return run(db)
+	}
+}
+
+// openSchemaDB opens the database that fly manages with the search path set to schema.
+func openSchemaDB(schema string) (*sql.DB, error) {
+	return connect(withSearchPath(targetDSN(), schema))
+}
+
+// withSearchPath adds the search_path run-time parameter to the connection
+// string, so that every connection of the pool uses the schema.
+func withSearchPath(dsn, schema string) string {
+	path := pq.QuoteIdentifier(schema)
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			q := u.Query()
+			q.Set("search_path", path)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return strings.TrimSpace(dsn + " search_path='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(path) + "'")
+}
+
+var (
+	identPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	tablePattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*\.)?[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// splitTable returns the schema, empty if the name is not qualified, and the
+// name of the migration table.
+func splitTable(table string) (schema, name string) {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return schema, name
+	}
+	return "", table
+}
+
+// progressTable returns the name of the table that records the progress of
+// migrations that run in steps: the migration table's, suffixed with
+// _progress.
+func progressTable(table string) string {
+	return table + "_progress"
+}
+
+// seedTable returns the name of the table that records the seeds that ran:
+// seed next to the default migration table, else the migration table's name
+// suffixed with _seed, so that applications sharing a database with -table
+// keep apart.
+func seedTable(table string) string {
+	schema, name := splitTable(table)
+	seed := "seed"
+	if name != "migration" {
+		seed = name + "_seed"
+	}
+	if schema != "" {
+		return schema + "." + seed
+	}
+	return seed
+}
+
+// connect opens the database identified by dsn and applies the connection pool settings.
+func connect(dsn string) (*sql.DB, error) {
+	if err := checkDriver(); err != nil {
+		return nil, err
+	}
+	// The table name is part of the SQL text: it cannot be a parameter.
+	if !tablePattern.MatchString(*migrationTable) {
+		return nil, fmt.Errorf("invalid -table %q: want a name or schema.name made of letters, digits and underscores", *migrationTable)
+	}
+	db, err := sql.Open(*driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(*maxOpenConns)
+	db.SetMaxIdleConns(*maxIdleConns)
+	db.SetConnMaxLifetime(*connMaxLifetime)
+	return db, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var driver = flag.String("driver", "postgres", "database `driver`: postgres, mysql or sqlite3; mysql and sqlite3 need a build with -tags mysql or -tags sqlite3")
+
+// dialect holds what the migration table bookkeeping needs to know about the
+// SQL of a database.
+type dialect struct {
+	// placeholder returns the parameter placeholder for the nth argument.
+	placeholder func(n int) string
+	// createMigrationTable creates the migration table, whose name is
+	// substituted for %s, if it does not exist.
+	createMigrationTable string
+	// ignoreConflict turns an INSERT statement into one that skips rows with an existing key.
+	ignoreConflict func(insert string) string
+	// upsert turns an INSERT statement into one that sets the given columns
+	// of the row with an existing key to the inserted values.
+	upsert func(insert, key string, cols ...string) string
+	// timestamp is the type of the columns that record when something ran.
+	timestamp string
+}
+
+var dialects = map[string]dialect{
+	"postgres": {
+		placeholder:          func(n int) string { return "$" + strconv.Itoa(n) },
+		createMigrationTable: "CREATE TABLE IF NOT EXISTS %s (id VARCHAR(256) PRIMARY KEY, applied TIMESTAMPTZ DEFAULT current_timestamp, checksum CHAR(64), applied_by VARCHAR(256), duration_ms INTEGER)",
+		ignoreConflict:       onConflictDoNothing,
+		upsert:               onConflictDoUpdate,
+		timestamp:            "TIMESTAMPTZ",
+	},
+	"mysql": {
+		placeholder:          func(int) string { return "?" },
+		createMigrationTable: "CREATE TABLE IF NOT EXISTS %s (id VARCHAR(256) PRIMARY KEY, applied TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6), checksum CHAR(64), applied_by VARCHAR(256), duration_ms INTEGER)",
+		ignoreConflict:       func(insert string) string { return strings.Replace(insert, "INSERT", "INSERT IGNORE", 1) },
+		upsert: func(insert, key string, cols ...string) string {
+			set := make([]string, len(cols))
+			for i, col := range cols {
+				set[i] = col + " = VALUES(" + col + ")"
+			}
+			return insert + " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+		},
+		timestamp: "TIMESTAMP(6)",
+	},
+	"sqlite3": {
+		placeholder:          func(int) string { return "?" },
+		createMigrationTable: "CREATE TABLE IF NOT EXISTS %s (id VARCHAR(256) PRIMARY KEY, applied TIMESTAMP DEFAULT CURRENT_TIMESTAMP, checksum CHAR(64), applied_by VARCHAR(256), duration_ms INTEGER)",
+		ignoreConflict:       onConflictDoNothing,
+		upsert:               onConflictDoUpdate,
+		timestamp:            "TIMESTAMP",
+	},
+}
+
+func onConflictDoNothing(insert string) string {
+	return insert + " ON CONFLICT (id) DO NOTHING"
+}
+
+func onConflictDoUpdate(insert, key string, cols ...string) string {
+	set := make([]string, len(cols))
+	for i, col := range cols {
+		set[i] = col + " = excluded." + col
+	}
+	return insert + " ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(set, ", ")
+}
+
+// checkDriver checks that -driver names a known driver that is compiled in.
+func checkDriver() error {
+	if _, ok := dialects[*driver]; !ok {
+		return fmt.Errorf("invalid -driver %q: want postgres, mysql or sqlite3", *driver)
+	}
+	if !slices.Contains(sql.Drivers(), *driver) {
+		return fmt.Errorf("driver %s is not built in: rebuild fly with -tags %s", *driver, *driver)
+	}
+	return nil
+}
+
+// sqlDialect returns the dialect of -driver, once connect has checked it.
+func sqlDialect() dialect {
+	return dialects[*driver]
+}
+
+var placeholderPattern = regexp.MustCompile(`\$\d+`)
+
+// bind rewrites the $1, $2... placeholders of query in the style of the
+// dialect. Placeholders must appear in order, as drivers with positional
+// placeholders bind the arguments in order.
+func (d dialect) bind(query string) string {
+	n := 0
+	return placeholderPattern.ReplaceAllStringFunc(query, func(string) string {
+		n++
+		return d.placeholder(n)
+	})
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestDialects(t *testing.T) {
+	tests := []struct {
+		driver       string
+		bind, upsert string
+	}{
+		{"postgres", "SELECT 1 FROM t WHERE a = $1 AND b = $2", "INSERT INTO t (id, n, m) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET n = excluded.n, m = excluded.m"},
+		{"mysql", "SELECT 1 FROM t WHERE a = ? AND b = ?", "INSERT INTO t (id, n, m) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE n = VALUES(n), m = VALUES(m)"},
+		{"sqlite3", "SELECT 1 FROM t WHERE a = ? AND b = ?", "INSERT INTO t (id, n, m) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET n = excluded.n, m = excluded.m"},
+	}
+	for _, tt := range tests {
+		d := dialects[tt.driver]
+		if got := d.bind("SELECT 1 FROM t WHERE a = $1 AND b = $2"); got != tt.bind {
+			t.Errorf("%s: bind = %q, want %q", tt.driver, got, tt.bind)
+		}
+		if got := d.bind(d.upsert("INSERT INTO t (id, n, m) VALUES ($1, $2, $3)", "id", "n", "m")); got != tt.upsert {
+			t.Errorf("%s: upsert = %q, want %q", tt.driver, got, tt.upsert)
+		}
+	}
+}
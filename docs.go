@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var output = flag.String("o", "", "`file` to write generated output to instead of stdout")
+
+// description returns the description of a migration script: its
+// fly:description directive, or else the first plain comment at its top.
+func description(script string) string {
+	if d, ok := directives(script)["description"]; ok {
+		return d
+	}
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		comment, ok := strings.CutPrefix(line, "--")
+		if !ok {
+			break
+		}
+		if comment = strings.TrimSpace(comment); comment != "" && !strings.HasPrefix(comment, "fly:") {
+			return comment
+		}
+	}
+	return ""
+}
+
+// migrationDescription returns the description of the up script of the
+// migration, or the empty string if the script cannot be read.
+func migrationDescription(fsys fs.FS, migration string) string {
+	if fsys == nil {
+		return ""
+	}
+	script, err := fs.ReadFile(fsys, migration+".up.sql")
+	if err != nil {
+		return ""
+	}
+	return description(string(script))
+}
+
+// createOutput opens the -o file, or returns stdout when there is none.
+func createOutput() (io.WriteCloser, error) {
+	if *output == "" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(*output)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func doDocs() error {
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+
+	// The applied state is a bonus: the catalog is still useful without a database.
+	var applied map[string]time.Time
+	if db, err := openDB(); err == nil {
+		if list, err := listAppliedMigrations(db, *migrationTable); err == nil {
+			applied = make(map[string]time.Time)
+			for _, m := range list {
+				applied[m.id] = m.applied
+			}
+		} else {
+			log.Printf("warning: applied state omitted: %v", err)
+		}
+	}
+
+	out, err := createOutput()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+
+	cell := strings.NewReplacer("|", `\|`, "\n", " ").Replace
+	fmt.Fprintln(w, "# Migrations")
+	fmt.Fprintln(w)
+	if applied != nil {
+		fmt.Fprintln(w, "| ID | Label | Description | Applied |")
+		fmt.Fprintln(w, "| -- | ----- | ----------- | ------- |")
+	} else {
+		fmt.Fprintln(w, "| ID | Label | Description |")
+		fmt.Fprintln(w, "| -- | ----- | ----------- |")
+	}
+	scripts := make(map[string]string)
+	for _, id := range migrations {
+		script, err := fs.ReadFile(fsys, id+".up.sql")
+		if err != nil {
+			return err
+		}
+		scripts[id] = string(script)
+		_, label, _ := strings.Cut(id, "_")
+		row := fmt.Sprintf("| [%s](#%s) | %s | %s |", id, strings.ToLower(id), cell(label), cell(description(string(script))))
+		if applied != nil {
+			state := "pending"
+			if t, ok := applied[id]; ok {
+				state = t.Format(time.DateTime)
+			}
+			row += " " + state + " |"
+		}
+		fmt.Fprintln(w, row)
+	}
+	for _, id := range migrations {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "## %s\n\n", id)
+		fmt.Fprintln(w, "<details>")
+		fmt.Fprintln(w, "<summary>up</summary>")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "```sql")
+		fmt.Fprintln(w, strings.TrimRight(scripts[id], "\n"))
+		fmt.Fprintln(w, "```")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "</details>")
+	}
+
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
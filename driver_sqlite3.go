@@ -0,0 +1,5 @@
+//go:build sqlite3
+
+package main
+
+import _ "github.com/mattn/go-sqlite3"
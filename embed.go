@@ -0,0 +1,22 @@
+//go:build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The migrations directory next to the sources is compiled into fly, which
+// then needs no migration files at run time.
+//
+//go:embed migrations
+var embeddedFiles embed.FS
+
+func init() {
+	fsys, err := fs.Sub(embeddedFiles, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	embedded = fsys
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var eventLog = flag.String("events", "", "`file` to append a JSON line to at each migration step, for metrics and logs")
+
+// observer is notified at each step of up and down. Direction is "up" or "down".
+type observer interface {
+	beforeMigration(direction, id string)
+	afterMigration(direction, id string, elapsed time.Duration)
+	migrationFailed(direction, id string, err error)
+}
+
+// observers receive the migration events, in order. They are notified one
+// event at a time, even when migrations are applied in parallel.
+var (
+	observers  = []observer{printer{}}
+	observerMu sync.Mutex
+)
+
+// printer is the default observer: it reports every completed step on stdout.
+type printer struct{}
+
+func (printer) beforeMigration(direction, id string) {}
+
+func (printer) afterMigration(direction, id string, elapsed time.Duration) {
+	fmt.Println(direction, id)
+}
+
+func (printer) migrationFailed(direction, id string, err error) {}
+
+// addObserver registers an observer after the ones already there.
+func addObserver(o observer) {
+	observerMu.Lock()
+	defer observerMu.Unlock()
+	observers = append(observers, o)
+}
+
+// openEventLog registers the observer that writes the events to the -events
+// file, if any.
+func openEventLog() error {
+	if *eventLog == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*eventLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("could not open event log: %v", err)
+	}
+	addObserver(eventWriter{json.NewEncoder(f)})
+	return nil
+}
+
+// eventWriter reports each step as a JSON object on a line of its own.
+type eventWriter struct {
+	enc *json.Encoder
+}
+
+type event struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Direction  string    `json:"direction"`
+	ID         string    `json:"id"`
+	DurationMS *int64    `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (w eventWriter) write(e event) {
+	e.Time = time.Now().UTC()
+	w.enc.Encode(e)
+}
+
+func (w eventWriter) beforeMigration(direction, id string) {
+	w.write(event{Event: "start", Direction: direction, ID: id})
+}
+
+func (w eventWriter) afterMigration(direction, id string, elapsed time.Duration) {
+	ms := elapsed.Milliseconds()
+	w.write(event{Event: "done", Direction: direction, ID: id, DurationMS: &ms})
+}
+
+func (w eventWriter) migrationFailed(direction, id string, err error) {
+	w.write(event{Event: "failed", Direction: direction, ID: id, Error: err.Error()})
+}
+
+// step runs fn as the given migration step, notifying the observers around it.
+// Errors are wrapped in a migrationError.
+func step(direction, id string, fn func() error) error {
+	notify(func(o observer) { o.beforeMigration(direction, id) })
+	start := time.Now()
+	if err := fn(); err != nil {
+		notify(func(o observer) { o.migrationFailed(direction, id, err) })
+		return &migrationError{id, err}
+	}
+	elapsed := time.Since(start)
+	notify(func(o observer) { o.afterMigration(direction, id, elapsed) })
+	return nil
+}
+
+func notify(event func(observer)) {
+	observerMu.Lock()
+	defer observerMu.Unlock()
+	for _, o := range observers {
+		event(o)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var exportFormat = flag.String("format", "csv", "output `format` of export")
+
+func doExport(db *sql.DB) error {
+	if *exportFormat != "csv" {
+		return fmt.Errorf("unsupported export format %q", *exportFormat)
+	}
+
+	migrations, err := listAppliedMigrations(db, *migrationTable)
+	if err != nil {
+		return err
+	}
+
+	out, err := createOutput()
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(out)
+	w.Write([]string{"id", "applied", "applied_by", "checksum", "duration_ms"})
+	for _, m := range migrations {
+		duration := ""
+		if m.duration.Valid {
+			duration = strconv.FormatInt(m.duration.Int64, 10)
+		}
+		w.Write([]string{m.id, m.applied.Format(time.RFC3339), m.appliedBy.String, m.checksum.String, duration})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// doExportPlan writes what up would do as a script for psql: the pending up
+// scripts, each followed by the insert that registers it, in one transaction.
+// Migrations with the fly:no-transaction directive are left out of the
+// transaction, between a COMMIT and a new BEGIN, as up does.
+func doExportPlan(db *sql.DB) error {
+	if flag.Arg(1) != "up" {
+		return errors.New("usage: fly export-plan up [-o file]")
+	}
+
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	table := *migrationTable
+	migrations, err := pendingMigrations(db, fsys, table)
+	if err != nil {
+		return err
+	}
+	if err := checkOrder(db, table, migrations); err != nil {
+		return err
+	}
+
+	out, err := createOutput()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, "BEGIN;")
+	for _, id := range migrations {
+		script, err := readScript(fsys, id+".up.sql")
+		if err != nil {
+			out.Close()
+			return err
+		}
+		sum, err := migrationChecksum(fsys, id)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		d := directives(string(script))
+		if _, batched := d["batch-key"]; batched {
+			out.Close()
+			return fmt.Errorf("batched migration %s cannot be exported as a plain script", id)
+		}
+		_, noTx := d["no-transaction"]
+		role := *execRole
+		if r, ok := d["role"]; ok {
+			role = r
+		}
+
+		fmt.Fprintf(w, "\n-- %s\n", id)
+		if noTx {
+			fmt.Fprintln(w, "COMMIT;")
+		}
+		if role != "" {
+			fmt.Fprintf(w, "SET ROLE %s;\n", pq.QuoteIdentifier(role))
+		}
+		fmt.Fprintln(w, strings.TrimRight(string(script), "\n"))
+		if !strings.HasSuffix(strings.TrimSpace(maskSQL(string(script))), ";") {
+			// The last statement must not run into the insert.
+			fmt.Fprintln(w, ";")
+		}
+		if role != "" {
+			fmt.Fprintln(w, "RESET ROLE;")
+		}
+		fmt.Fprintf(w, "INSERT INTO %s (id, checksum) VALUES (%s, %s);\n", table, pq.QuoteLiteral(id), pq.QuoteLiteral(sum))
+		if noTx {
+			fmt.Fprintln(w, "BEGIN;")
+		}
+	}
+	fmt.Fprintln(w, "\nCOMMIT;")
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
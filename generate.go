@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// template writes the starting up and down scripts of a kind of migration
+// from its arguments.
+type template struct {
+	kind  string
+	usage string
+	write func(args []string) (up, down string)
+}
+
+var templates = []template{
+	{"create-table", "<table>", func(args []string) (string, string) {
+		return fmt.Sprintf("CREATE TABLE %s (\n\tid BIGSERIAL PRIMARY KEY\n);\n", args[0]),
+			fmt.Sprintf("DROP TABLE %s;\n", args[0])
+	}},
+	{"add-column", "<table> <column> [type]", func(args []string) (string, string) {
+		typ := "TEXT"
+		if len(args) > 2 {
+			typ = strings.Join(args[2:], " ")
+		}
+		return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;\n", args[0], args[1], typ),
+			fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s;\n", args[0], args[1])
+	}},
+	{"create-index", "<table> <column>...", func(args []string) (string, string) {
+		name := strings.Join(args, "_") + "_idx"
+		return fmt.Sprintf("CREATE INDEX %s ON %s (%s);\n", name, args[0], strings.Join(args[1:], ", ")),
+			fmt.Sprintf("DROP INDEX %s;\n", name)
+	}},
+}
+
+// doGenerate creates a migration whose up and down scripts are filled in from
+// a template, for the usual operations. The scripts are meant to be edited.
+func doGenerate() error {
+	kind := flag.Arg(1)
+	i := slices.IndexFunc(templates, func(t template) bool { return t.kind == kind })
+	if i < 0 {
+		var kinds []string
+		for _, t := range templates {
+			kinds = append(kinds, "  fly generate "+t.kind+" "+t.usage)
+		}
+		if kind == "" {
+			return fmt.Errorf("usage:\n%s", strings.Join(kinds, "\n"))
+		}
+		return fmt.Errorf("unknown kind %s, want one of:\n%s", kind, strings.Join(kinds, "\n"))
+	}
+	t := templates[i]
+
+	// The names are the required arguments, which the usage puts in <>.
+	args := flag.Args()[2:]
+	n := strings.Count(t.usage, "<")
+	if len(args) < n {
+		return fmt.Errorf("usage: fly generate %s %s", t.kind, t.usage)
+	}
+	for _, name := range args[:n] {
+		if !identPattern.MatchString(name) {
+			return fmt.Errorf("invalid name %q: want letters, digits and underscores", name)
+		}
+	}
+
+	up, down := t.write(args)
+	label := strings.ReplaceAll(t.kind, "-", "_") + "_" + strings.Join(args[:n], "_")
+	id, err := createMigration(label, []byte(up), []byte(down))
+	if err != nil {
+		return err
+	}
+	fmt.Println("new", id)
+	stageMigration(id)
+	return nil
+}
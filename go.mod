@@ -2,4 +2,10 @@ module github.com/lorciv/fly
 
 go 1.25.5
 
-require github.com/lib/pq v1.10.9
+require (
+	github.com/go-sql-driver/mysql v1.10.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.52
+)
+
+require filippo.io/edwards25519 v1.2.0 // indirect
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	idRegex  = flag.String("id-regex", `^(\d+)_`, "regular `expression` that migration IDs must match; its serial group, or else its first group, captures the numeric serial")
+	idFormat = flag.String("id-format", "serial", "how new names migrations: serial (0012_label), date-serial (20240115_0001_label) or timestamp (20240521153000_label)")
+)
+
+// idPattern compiles -id-regex.
+var idPattern = sync.OnceValues(func() (*regexp.Regexp, error) {
+	re, err := regexp.Compile(*idRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -id-regex: %v", err)
+	}
+	if re.NumSubexp() == 0 {
+		return nil, fmt.Errorf("invalid -id-regex: no group captures the serial")
+	}
+	return re, nil
+})
+
+// splitID splits a migration ID around its serial: the ID is
+// prefix + serial + sep + label, where prefix + serial + sep is the text
+// matched by -id-regex.
+func splitID(re *regexp.Regexp, id string) (prefix, serial, sep string, ok bool) {
+	m := re.FindStringSubmatchIndex(id)
+	if m == nil {
+		return "", "", "", false
+	}
+	group := 1
+	if i := re.SubexpIndex("serial"); i > 0 {
+		group = i
+	}
+	start, end := m[2*group], m[2*group+1]
+	if start < 0 {
+		return "", "", "", false
+	}
+	return id[:start], id[start:end], id[end:m[1]], true
+}
+
+// compareIDs orders migration IDs by serial, then lexicographically.
+func compareIDs(a, b string) int {
+	if re, err := idPattern(); err == nil {
+		_, sa, _, _ := splitID(re, a)
+		_, sb, _, _ := splitID(re, b)
+		sa, sb = strings.TrimLeft(sa, "0"), strings.TrimLeft(sb, "0")
+		if c := cmp.Compare(len(sa), len(sb)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(sa, sb); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// nextID returns the ID of a migration with the given label that comes after
+// last, following the naming scheme of last. When there is no migration yet,
+// the default scheme is used.
+func nextID(last, label string) (string, error) {
+	re, err := idPattern()
+	if err != nil {
+		return "", err
+	}
+	if last == "" {
+		id := "0001_" + label
+		if !re.MatchString(id) {
+			return "", fmt.Errorf("cannot name the first migration after -id-regex %s: create it by hand", *idRegex)
+		}
+		return id, nil
+	}
+
+	prefix, serial, sep, ok := splitID(re, last)
+	if !ok {
+		return "", fmt.Errorf("invalid migration %s: does not match -id-regex", last)
+	}
+	n, err := strconv.ParseUint(serial, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid migration %s: %v", last, err)
+	}
+	return fmt.Sprintf("%s%0*d%s%s", prefix, len(serial), n+1, sep, label), nil
+}
+
+// nextDateID returns the ID of a migration with the given label created on
+// the given day, in the date-serial format: the date, then a serial that
+// counts the migrations of that day. The day is taken in UTC, so that it does
+// not depend on the time zone of the developer.
+func nextDateID(migrations []string, label string, day time.Time) string {
+	prefix := day.UTC().Format("20060102") + "_"
+	n := 0
+	for _, id := range migrations {
+		serial, _, ok := strings.Cut(strings.TrimPrefix(id, prefix), "_")
+		if !ok || !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		if i, err := strconv.Atoi(serial); err == nil {
+			n = max(n, i)
+		}
+	}
+	return fmt.Sprintf("%s%04d_%s", prefix, n+1, label)
+}
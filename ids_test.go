@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNextID(t *testing.T) {
+	tests := []struct {
+		last, label string
+		want        string
+	}{
+		{"", "init", "0001_init"},
+		{"0007_a", "b", "0008_b"},
+		{"0009_a", "b", "0010_b"},
+		{"9999_a", "b", "10000_b"},
+		{"42_a", "b", "43_b"},
+	}
+	for _, tt := range tests {
+		got, err := nextID(tt.last, tt.label)
+		if err != nil {
+			t.Errorf("nextID(%q, %q): %v", tt.last, tt.label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("nextID(%q, %q) = %q, want %q", tt.last, tt.label, got, tt.want)
+		}
+	}
+}
+
+func TestNextDateID(t *testing.T) {
+	day := time.Date(2024, 1, 15, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*3600))
+	tests := []struct {
+		migrations []string
+		want       string
+	}{
+		{nil, "20240116_0001_x"},
+		{[]string{"20240115_0003_a"}, "20240116_0001_x"},
+		{[]string{"20240116_0001_a", "20240116_0002_b"}, "20240116_0003_x"},
+	}
+	for _, tt := range tests {
+		if got := nextDateID(tt.migrations, "x", day); got != tt.want {
+			t.Errorf("nextDateID(%q) = %q, want %q", tt.migrations, got, tt.want)
+		}
+	}
+}
+
+func TestCreateMigration(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"empty directory", nil, "0001_add_users"},
+		{"up and down", []string{"0007_a.up.sql", "0007_a.down.sql"}, "0008_add_users"},
+		{"stray file sorts last", []string{"0007_a.up.sql", "0007_a.down.sql", "zz_notes.txt"}, "0008_add_users"},
+		{"down without up", []string{"0007_a.up.sql", "0009_b.down.sql"}, "0008_add_users"},
+		{"out of order", []string{"0009_a.up.sql", "0010_b.up.sql", "0002_c.up.sql"}, "0011_add_users"},
+	}
+	defer func(dir, format string) {
+		flag.Set("sourcedir", dir)
+		*idFormat = format
+		source = nil
+	}(*sourcedir, *idFormat)
+	*idFormat = "serial"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			flag.Set("sourcedir", dir)
+			source = nil
+
+			id, err := createMigration("add users", []byte("up"), []byte("down"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.want {
+				t.Errorf("createMigration = %q, want %q", id, tt.want)
+			}
+			for _, name := range []string{id + ".up.sql", id + ".down.sql"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("%s not written: %v", name, err)
+				}
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(entries), len(tt.files)+2; got != want {
+				t.Errorf("%d files in the directory, want %d", got, want)
+			}
+		})
+	}
+
+	t.Run("missing directory", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "migrations")
+		flag.Set("sourcedir", dir)
+		source = nil
+		id, err := createMigration("init", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "0001_init" {
+			t.Errorf("createMigration = %q, want 0001_init", id)
+		}
+		names, err := listDirMigrations(os.DirFS(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(names, []string{"0001_init"}) {
+			t.Errorf("migrations = %q, want [0001_init]", names)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+)
+
+// doList prints every migration known to the source or to the database, one
+// per line in serial order, after a letter giving its state: A for applied, P
+// for pending (not applied) and M for missing (applied, without a file). The
+// output has no headers nor times, so that it can be diffed across runs.
+func doList(db *sql.DB) error {
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	onDisk, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	applied, err := listAppliedMigrations(db, *migrationTable)
+	if err != nil {
+		return err
+	}
+
+	state := make(map[string]string)
+	for _, id := range onDisk {
+		state[id] = "P"
+	}
+	for _, m := range applied {
+		if state[m.id] == "P" {
+			state[m.id] = "A"
+		} else {
+			state[m.id] = "M"
+		}
+	}
+	ids := make([]string, 0, len(state))
+	for id := range state {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, compareIDs)
+	for _, id := range ids {
+		fmt.Println(state[id], id)
+	}
+	return nil
+}
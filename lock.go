@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+var lockfile = flag.String("lockfile", "", "`file` that up and down keep in sync with the applied migrations, for verify-lock")
+
+// writeLockfile records the applied migrations and their checksums in the
+// lockfile, if one is configured.
+func writeLockfile(db *sql.DB, table string) error {
+	if *lockfile == "" {
+		return nil
+	}
+	migrations, err := listAppliedMigrations(db, table)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "# Applied migrations and their checksums. Generated by fly, do not edit.")
+	for _, m := range migrations {
+		sum := m.checksum.String
+		if !m.checksum.Valid {
+			sum = "-"
+		}
+		fmt.Fprintln(&b, m.id, sum)
+	}
+	return os.WriteFile(*lockfile, []byte(b.String()), 0666)
+}
+
+// readLockfile returns the checksums recorded in the lockfile by migration ID,
+// in the order they appear.
+func readLockfile(filename string) (ids []string, sums map[string]string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	sums = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, sum, found := strings.Cut(line, " ")
+		if !found {
+			return nil, nil, fmt.Errorf("%s:%d: missing checksum", filename, n)
+		}
+		ids = append(ids, id)
+		sums[id] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return ids, sums, nil
+}
+
+// doVerifyLock checks the lockfile that up and down keep, which must be given
+// with -lockfile as they only keep one when it is, against the database and
+// the source.
+func doVerifyLock(db *sql.DB) error {
+	if *lockfile == "" {
+		return errors.New("verify-lock requires -lockfile, the file that up and down keep")
+	}
+	ids, locked, err := readLockfile(*lockfile)
+	if err != nil {
+		return err
+	}
+
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	applied, err := listAppliedMigrations(db, *migrationTable)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	inDB := make(map[string]bool)
+	for _, m := range applied {
+		inDB[m.id] = true
+		sum, ok := locked[m.id]
+		switch {
+		case !ok:
+			problems = append(problems, m.id+" is applied but not in the lockfile")
+		case m.checksum.Valid && sum != m.checksum.String:
+			problems = append(problems, m.id+" was applied with a different checksum than the locked one")
+		}
+	}
+	for _, id := range ids {
+		if !inDB[id] {
+			problems = append(problems, id+" is locked but not applied")
+		}
+		sum, err := migrationChecksum(fsys, id)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			problems = append(problems, id+" is locked but missing from the source")
+		case err != nil:
+			return err
+		case locked[id] != "-" && sum != locked[id]:
+			problems = append(problems, id+" differs from the locked checksum")
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database, lockfile and source disagree in %d place(s)", len(problems))
+	}
+	return nil
+}
@@ -1,39 +1,137 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"os/exec"
+	"os/user"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // initMigrationTable ensures that the migration table on the database is present.
-func initMigrationTable(db *sql.DB) error {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS migration (id VARCHAR(256) PRIMARY KEY, applied TIMESTAMP DEFAULT current_timestamp)")
+func initMigrationTable(db *sql.DB, table string) error {
+	_, err := db.Exec(fmt.Sprintf(sqlDialect().createMigrationTable, table))
 	if err != nil {
 		return fmt.Errorf("could not create migration table: %v", err)
 	}
+	if *driver != "postgres" {
+		// These tables may predate the audit columns only.
+		for _, col := range []string{"applied_by VARCHAR(256)", "duration_ms INTEGER"} {
+			name, _, _ := strings.Cut(col, " ")
+			if _, err := db.Exec("SELECT " + name + " FROM " + table + " WHERE 1 = 0"); err == nil {
+				continue
+			}
+			if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + col); err != nil {
+				return fmt.Errorf("could not upgrade migration table: %v", err)
+			}
+		}
+		return nil
+	}
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS checksum CHAR(64), ADD COLUMN IF NOT EXISTS applied_by VARCHAR(256), ADD COLUMN IF NOT EXISTS duration_ms INTEGER"); err != nil {
+		return fmt.Errorf("could not upgrade migration table: %v", err)
+	}
+
+	// Tables created by older versions store applied as a timezone-naive TIMESTAMP.
+	// Existing values are converted assuming the session time zone.
+	var dataType string
+	schema, name := splitTable(table)
+	err = db.QueryRow("SELECT data_type FROM information_schema.columns WHERE table_schema = coalesce(NULLIF($1, ''), current_schema()) AND table_name = $2 AND column_name = 'applied'", schema, name).Scan(&dataType)
+	if err != nil {
+		return fmt.Errorf("could not inspect migration table: %v", err)
+	}
+	if dataType == "timestamp without time zone" {
+		if _, err := db.Exec("ALTER TABLE " + table + " ALTER COLUMN applied TYPE TIMESTAMPTZ"); err != nil {
+			return fmt.Errorf("could not upgrade migration table: %v", err)
+		}
+	}
 	return nil
 }
 
 // migration represents a migration applied to the database.
 type migration struct {
-	id      string
-	applied time.Time
+	id       string
+	applied  time.Time
+	checksum sql.NullString // not recorded for migrations applied by older versions
+
+	// Not recorded for migrations applied by older versions, nor duration
+	// for migrations that were marked applied without running.
+	appliedBy sql.NullString
+	duration  sql.NullInt64 // milliseconds
+}
+
+// migrationError reports the migration that a command failed on.
+type migrationError struct {
+	id  string
+	err error
+}
+
+func (e *migrationError) Error() string { return e.err.Error() }
+func (e *migrationError) Unwrap() error { return e.err }
+
+// exitError makes fly exit with a specific status code.
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e *exitError) Error() string { return e.msg }
+
+// listAppliedMigrations reads all migrations that have been executed on the
+// database, in the order they were applied. Migrations applied at the same
+// time, by baseline, in a single transaction or within the resolution of the
+// clock, are ordered by ID like the migration files.
+func listAppliedMigrations(db *sql.DB, table string) ([]migration, error) {
+	migrations, err := queryMigrations(db, "SELECT id, applied, checksum, applied_by, duration_ms FROM "+table+" ORDER BY applied")
+	if err != nil {
+		return nil, err
+	}
+	// SQL would compare the IDs as strings, putting 9999_a after 10000_b.
+	slices.SortStableFunc(migrations, func(a, b migration) int {
+		if c := a.applied.Compare(b.applied); c != 0 {
+			return c
+		}
+		return compareIDs(a.id, b.id)
+	})
+	return migrations, nil
+}
+
+// listRecentMigrations reads the limit most recently applied migrations,
+// skipping the offset most recent ones, and counts all applied migrations.
+// A limit of 0 means no limit. The migrations are sorted like listAppliedMigrations.
+func listRecentMigrations(db *sql.DB, table string, limit, offset int) ([]migration, int, error) {
+	migrations, err := listAppliedMigrations(db, table)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(migrations)
+	end := max(total-offset, 0)
+	start := 0
+	if limit > 0 {
+		start = max(end-limit, 0)
+	}
+	return migrations[start:end], total, nil
 }
 
-// listAppliedMigrations reads all migrations that have been executed on the database.
-func listAppliedMigrations(db *sql.DB) ([]migration, error) {
-	rows, err := db.Query("SELECT id, applied FROM migration ORDER BY applied, id")
+func queryMigrations(db *sql.DB, query string, args ...any) ([]migration, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +140,7 @@ func listAppliedMigrations(db *sql.DB) ([]migration, error) {
 	var records []migration
 	for rows.Next() {
 		var r migration
-		if err := rows.Scan(&r.id, &r.applied); err != nil {
+		if err := rows.Scan(&r.id, &r.applied, &r.checksum, &r.appliedBy, &r.duration); err != nil {
 			return nil, err
 		}
 		records = append(records, r)
@@ -54,9 +152,9 @@ func listAppliedMigrations(db *sql.DB) ([]migration, error) {
 }
 
 // isMigrationApplied checks if the migration has run on the database.
-func isMigrationApplied(db *sql.DB, migration string) (bool, error) {
+func isMigrationApplied(db *sql.DB, table, migration string) (bool, error) {
 	var found int
-	err := db.QueryRow("SELECT 1 FROM migration WHERE id = $1", migration).Scan(&found)
+	err := db.QueryRow(sqlDialect().bind("SELECT 1 FROM "+table+" WHERE id = $1"), migration).Scan(&found)
 	if err == sql.ErrNoRows {
 		return false, nil
 	}
@@ -66,9 +164,13 @@ func isMigrationApplied(db *sql.DB, migration string) (bool, error) {
 	return true, nil
 }
 
-// listDirMigrations reads all migrations from the configured directory, sorted by increasing ID.
-func listDirMigrations() ([]string, error) {
-	entries, err := os.ReadDir(*sourcedir)
+// listDirMigrations reads all migrations from the migration source, sorted by increasing ID.
+func listDirMigrations(fsys fs.FS) ([]string, error) {
+	re, err := idPattern()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(fsys, ".")
 	if err != nil {
 		return nil, err
 	}
@@ -76,238 +178,1939 @@ func listDirMigrations() ([]string, error) {
 	var migrations []string
 	for _, e := range entries {
 		id, found := strings.CutSuffix(e.Name(), ".up.sql")
-		if found {
-			migrations = append(migrations, id)
+		if !found {
+			continue
+		}
+		if !re.MatchString(id) {
+			return nil, fmt.Errorf("invalid migration %s: does not match -id-regex %s", id, *idRegex)
 		}
+		migrations = append(migrations, id)
 	}
 
-	sort.Strings(migrations)
+	slices.SortFunc(migrations, compareIDs)
 
 	return migrations, nil
 }
 
-// runScript executes the SQL script on the database.
-func runScript(tx *sql.Tx, filename string) error {
-	script, err := os.ReadFile(filename)
+// pendingMigrations lists the migrations in fsys that have not been applied yet, sorted by increasing ID.
+func pendingMigrations(db *sql.DB, fsys fs.FS, table string) ([]string, error) {
+	migrations, err := listDirMigrations(fsys)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if _, err := tx.Exec(string(script)); err != nil {
-		return fmt.Errorf("could not run %s: %s", filename, err)
+	var pending []string
+	for _, id := range migrations {
+		ok, err := isMigrationApplied(db, table, id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			pending = append(pending, id)
+		}
 	}
-	return nil
+	return pending, nil
 }
 
-// registerMigration inserts a new row for the given migration into the migration table.
-func registerMigration(tx *sql.Tx, migration string) error {
-	_, err := tx.Exec("INSERT INTO migration (id) VALUES ($1)", migration)
+// compareMigrations classifies migrations as pending, when they are in fsys
+// but not applied, and missing, when they are applied but not in fsys.
+func compareMigrations(db *sql.DB, fsys fs.FS, table string) (pending, missing []string, err error) {
+	onDisk, err := listDirMigrations(fsys)
 	if err != nil {
-		return fmt.Errorf("could not create migration: %v", err)
+		return nil, nil, err
 	}
-	return nil
+	applied, err := listAppliedMigrations(db, table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	isApplied := make(map[string]bool)
+	for _, m := range applied {
+		isApplied[m.id] = true
+	}
+	for _, id := range onDisk {
+		if !isApplied[id] {
+			pending = append(pending, id)
+		}
+		delete(isApplied, id)
+	}
+	for _, m := range applied {
+		if isApplied[m.id] {
+			missing = append(missing, m.id)
+		}
+	}
+	return pending, missing, nil
 }
 
-// unregisterMigration deletes the row for the given migration from the migration table.
-func unregisterMigration(tx *sql.Tx, migration string) error {
-	_, err := tx.Exec("DELETE FROM migration WHERE id = $1", migration)
+// checkOrder refuses pending migrations that sort before the latest applied
+// one, unless -allow-out-of-order is set.
+func checkOrder(db *sql.DB, table string, pending []string) error {
+	applied, err := listAppliedMigrations(db, table)
 	if err != nil {
-		return fmt.Errorf("could not delete migration: %v", err)
+		return err
+	}
+	latest := ""
+	for _, m := range applied {
+		if compareIDs(m.id, latest) > 0 {
+			latest = m.id
+		}
+	}
+	for _, id := range pending {
+		if compareIDs(id, latest) > 0 {
+			continue
+		}
+		if !*allowOutOfOrder {
+			return fmt.Errorf("migration %s is older than applied migration %s (use -allow-out-of-order to apply it anyway)", id, latest)
+		}
+		log.Printf("warning: applying %s out of order, after %s", id, latest)
 	}
 	return nil
 }
 
-var sourcedir = flag.String("sourcedir", "migrations", "directory that contains database migration files")
-
-func doInit() error {
-	db, err := sql.Open("postgres", "")
+// reconcileChecksums looks for applied migrations whose up file changed since
+// they were applied. It warns about them, or with -confirm-checksum asks
+// whether to record the new checksum, without running the migration again.
+func reconcileChecksums(ctx context.Context, db *sql.DB, tx *sql.Tx, fsys fs.FS, table string) error {
+	applied, err := listAppliedMigrations(db, table)
 	if err != nil {
 		return err
 	}
-	if err := initMigrationTable(db); err != nil {
-		return err
+	for _, m := range applied {
+		sum, err := migrationChecksum(fsys, m.id)
+		if errors.Is(err, fs.ErrNotExist) || !m.checksum.Valid {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if sum == m.checksum.String {
+			continue
+		}
+
+		if !*confirmChecksum {
+			log.Printf("warning: migration %s changed since it was applied", m.id)
+			continue
+		}
+		if !interactive() {
+			return fmt.Errorf("migration %s changed since it was applied", m.id)
+		}
+		ok, err := confirm(ctx, fmt.Sprintf("migration %s changed since it was applied; update recorded checksum?", m.id))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("migration %s changed since it was applied", m.id)
+		}
+		if _, err := tx.Exec(sqlDialect().bind("UPDATE "+table+" SET checksum = $1 WHERE id = $2"), sum, m.id); err != nil {
+			return fmt.Errorf("could not update checksum of %s: %v", m.id, err)
+		}
 	}
 	return nil
 }
 
-func doStatus() error {
-	db, err := sql.Open("postgres", "")
-	if err != nil {
-		return err
+// checkDestructive looks for destructive statements in the up scripts of the
+// migrations. Unless -allow-destructive is set, they must be confirmed
+// interactively; without a terminal they are refused.
+func checkDestructive(ctx context.Context, fsys fs.FS, migrations []string) error {
+	var found []string
+	for _, id := range migrations {
+		script, err := fs.ReadFile(fsys, id+".up.sql")
+		if err != nil {
+			return err
+		}
+		if stmts := findDestructive(string(script)); len(stmts) > 0 {
+			found = append(found, fmt.Sprintf("%s (%s)", id, strings.Join(stmts, ", ")))
+		}
+	}
+	if len(found) == 0 || *allowDestructive {
+		return nil
 	}
 
-	migrations, err := listAppliedMigrations(db)
+	for _, f := range found {
+		log.Printf("destructive: %s", f)
+	}
+	if !interactive() {
+		return errors.New("refusing to apply destructive migrations (use -allow-destructive)")
+	}
+	ok, err := confirm(ctx, "apply destructive migrations?")
 	if err != nil {
 		return err
 	}
+	if !ok {
+		return errors.New("destructive migrations not confirmed")
+	}
+	return nil
+}
 
-	writer := tabwriter.NewWriter(os.Stdout, 1, 3, 1, ' ', 0)
-	format := "%s\t%s\n"
-	fmt.Fprintf(writer, format, "ID", "APPLIED")
-	fmt.Fprintf(writer, format, "--", "-------")
-	if len(migrations) > 10 {
-		fmt.Fprintf(writer, format, "...", "...")
+// checkSafe refuses migrations with contracting operations, unless their up
+// script has the fly:contract directive.
+func checkSafe(fsys fs.FS, migrations []string) error {
+	var found []string
+	for _, id := range migrations {
+		script, err := fs.ReadFile(fsys, id+".up.sql")
+		if err != nil {
+			return err
+		}
+		if _, ok := directives(string(script))["contract"]; ok {
+			continue
+		}
+		if ops := findContracting(string(script)); len(ops) > 0 {
+			found = append(found, fmt.Sprintf("%s (%s)", id, strings.Join(ops, ", ")))
+		}
+	}
+	if len(found) == 0 {
+		return nil
 	}
-	for _, m := range migrations[len(migrations)-10:] {
-		fmt.Fprintf(writer, format, m.id, m.applied.Format(time.DateTime))
+	for _, f := range found {
+		log.Printf("contracting: %s", f)
 	}
-	writer.Flush()
+	return fmt.Errorf("refusing to apply %d contracting migration(s) in safe mode", len(found))
+}
 
+// checkReadOnly runs the up script of each migration in a read-only
+// transaction that is then rolled back, and reports the migrations that write.
+// Nothing is applied or registered.
+func checkReadOnly(db *sql.DB, fsys fs.FS, migrations []string) error {
+	writers := 0
+	for _, id := range migrations {
+		tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		err = runScript(context.Background(), tx, fsys, id+".up.sql")
+		tx.Rollback()
+		if err != nil {
+			fmt.Println("writes", id+":", err)
+			writers++
+			continue
+		}
+		fmt.Println("read-only", id)
+	}
+	if writers > 0 {
+		return fmt.Errorf("%d migration(s) failed in a read-only transaction", writers)
+	}
 	return nil
 }
 
-func doNew() error {
-	last := "0000_unnamed.up.sql"
-	entries, err := os.ReadDir(*sourcedir)
+// parseIsolation parses an isolation level name such as "repeatable read" or
+// "serializable". The empty name stands for the driver default.
+func parseIsolation(name string) (sql.IsolationLevel, error) {
+	switch strings.NewReplacer("-", " ", "_", " ").Replace(strings.ToLower(name)) {
+	case "":
+		return sql.LevelDefault, nil
+	case "read uncommitted":
+		return sql.LevelReadUncommitted, nil
+	case "read committed":
+		return sql.LevelReadCommitted, nil
+	case "repeatable read":
+		return sql.LevelRepeatableRead, nil
+	case "serializable":
+		return sql.LevelSerializable, nil
+	}
+	return 0, fmt.Errorf("unknown isolation level %q", name)
+}
+
+// migrationIsolation returns the isolation level of the transaction that
+// applies the migrations: the strictest of -isolation and their fly:isolation directives.
+func migrationIsolation(fsys fs.FS, migrations []string) (sql.IsolationLevel, error) {
+	level, err := parseIsolation(*isolation)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if len(entries) > 0 {
-		last = entries[len(entries)-1].Name()
+	for _, id := range migrations {
+		script, err := fs.ReadFile(fsys, id+".up.sql")
+		if err != nil {
+			return 0, err
+		}
+		l, err := parseIsolation(directives(string(script))["isolation"])
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", id, err)
+		}
+		level = max(level, l)
 	}
+	return level, nil
+}
 
-	serial, _, found := strings.Cut(last, "_")
-	if !found {
-		return errors.New("invalid filename: missing counter")
+// verbosef logs a debugging message if -verbose is set.
+func verbosef(format string, args ...any) {
+	if *verbose {
+		log.Printf(format, args...)
 	}
-	n, err := strconv.Atoi(serial)
+}
+
+// runScript executes the SQL script read from fsys on the database.
+// The script runs as the role named by its fly:role directive or by -role, if any.
+func runScript(ctx context.Context, tx *sql.Tx, fsys fs.FS, filename string) error {
+	script, err := readScript(fsys, filename)
 	if err != nil {
-		return fmt.Errorf("invalid filename: %s", err)
+		return err
 	}
 
-	nextSerial := fmt.Sprintf("%04d", n+1)
-
-	label := flag.Arg(1)
-	if label == "" {
-		label = "unnamed"
+	role := *execRole
+	if r, ok := directives(string(script))["role"]; ok {
+		role = r
+	}
+	if role != "" {
+		if _, err := tx.ExecContext(ctx, "SET LOCAL ROLE "+pq.QuoteIdentifier(role)); err != nil {
+			return fmt.Errorf("could not run %s as %s: %v", filename, role, err)
+		}
 	}
-	label = strings.ReplaceAll(label, " ", "_")
 
-	for _, t := range []string{"up", "down"} {
-		filename := fmt.Sprintf("%s/%s_%s.%s.sql", *sourcedir, nextSerial, label, t)
-		if _, err := os.Create(filename); err != nil {
+	if *lockTimeout > 0 && *driver == "postgres" {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL lock_timeout = %d", lockTimeout.Milliseconds())); err != nil {
 			return err
 		}
 	}
 
+	if *noSplit {
+		verbosef("%s:\n%s", filename, script)
+		if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+			return fmt.Errorf("could not run %s: %s", filename, err)
+		}
+	} else {
+		// Not every driver accepts several statements in one Exec.
+		for i, stmt := range splitStatements(string(script)) {
+			verbosef("%s: statement %d:\n%s", filename, i+1, stmt)
+			if err := execStatement(ctx, tx, stmt); err != nil {
+				return fmt.Errorf("could not run %s: statement %d: %v", filename, i+1, err)
+			}
+		}
+	}
+
+	if role != "" {
+		if _, err := tx.ExecContext(ctx, "RESET ROLE"); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func doUp() error {
-	db, err := sql.Open("postgres", "")
+// execStatement runs a statement of a script. With -stmt-retries, it runs
+// under a savepoint: if it could not get a lock within the lock timeout, it is
+// rolled back to its savepoint and tried again, up to -stmt-retries times,
+// waiting twice as long before each new attempt.
+func execStatement(ctx context.Context, tx *sql.Tx, stmt string) error {
+	if *stmtRetries == 0 {
+		_, err := tx.ExecContext(ctx, stmt)
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT fly_statement"); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, stmt)
+		if err == nil {
+			break
+		}
+		var perr *pq.Error
+		if !errors.As(err, &perr) || perr.Code != "55P03" || attempt == *stmtRetries {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT fly_statement"); err != nil {
+			return err
+		}
+		delay := 100 * time.Millisecond << attempt
+		log.Printf("lock timeout, retrying in %v: %.60s", delay, stmt)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	_, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT fly_statement")
+	return err
+}
+
+// checksum returns the hex-encoded SHA-256 of the script.
+func checksum(script []byte) string {
+	sum := sha256.Sum256(script)
+	return hex.EncodeToString(sum[:])
+}
+
+// migrationChecksum computes the checksum recorded for the migration when it
+// is applied. With -checksum-down it covers the down file too, appended to the
+// up file; a missing down file counts as empty.
+func migrationChecksum(fsys fs.FS, migration string) (string, error) {
+	script, err := fs.ReadFile(fsys, migration+".up.sql")
+	if err != nil {
+		return "", err
+	}
+	if *checksumDown {
+		down, err := fs.ReadFile(fsys, migration+".down.sql")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		script = append(script, down...)
+	}
+	return checksum(script), nil
+}
+
+// appliedBy identifies who applies migrations: the OS user and the host.
+var appliedBy = sync.OnceValue(func() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
 	if err != nil {
+		host = "unknown"
+	}
+	return name + "@" + host
+})
+
+// applyInTx runs the up script of the migration in tx and registers it.
+func applyInTx(ctx context.Context, tx *sql.Tx, fsys fs.FS, table, migration string) error {
+	start := time.Now()
+	if err := runScript(ctx, tx, fsys, migration+".up.sql"); err != nil {
 		return err
 	}
-	tx, err := db.Begin()
+	elapsed := time.Since(start)
+	sum, err := migrationChecksum(fsys, migration)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	return registerMigration(tx, table, migration, sum, elapsed)
+}
+
+// registerMigration inserts a new row for the given migration into the migration table.
+// Elapsed is how long its script took to run, 0 if it was not run.
+// When -on-conflict is ignore, registering an already present migration is a no-op.
+func registerMigration(tx *sql.Tx, table, migration, checksum string, elapsed time.Duration) error {
+	query := "INSERT INTO " + table + " (id, checksum, applied_by, duration_ms) VALUES ($1, $2, $3, $4)"
+	switch *onConflict {
+	case "error":
+	case "ignore":
+		query = sqlDialect().ignoreConflict(query)
+	default:
+		return fmt.Errorf("invalid -on-conflict %q: want error or ignore", *onConflict)
+	}
+	duration := sql.NullInt64{Int64: elapsed.Milliseconds(), Valid: elapsed > 0}
+	_, err := tx.Exec(sqlDialect().bind(query), migration, checksum, appliedBy(), duration)
+	if err != nil {
+		return fmt.Errorf("could not create migration: %v", err)
+	}
+	return nil
+}
 
-	migrations, err := listDirMigrations()
+// unregisterMigration deletes the row for the given migration from the migration table.
+func unregisterMigration(tx *sql.Tx, table, migration string) error {
+	_, err := tx.Exec(sqlDialect().bind("DELETE FROM "+table+" WHERE id = $1"), migration)
 	if err != nil {
+		return fmt.Errorf("could not delete migration: %v", err)
+	}
+	return nil
+}
+
+var (
+	sourcedir     = flag.String("sourcedir", "migrations", "directory that contains database migration files")
+	sourceArchive = flag.String("source", "", "tar `archive` (optionally gzipped) to read migration files from instead of sourcedir")
+	seeddir       = flag.String("seeddir", "seeds", "directory that contains data seeding files")
+	seedStrict    = flag.Bool("seed-strict", false, "refuse to run seed files that contain schema changes")
+	shadowDSN     = flag.String("shadow-dsn", "", "connection string of a throwaway database used for verification")
+
+	exitCode         = flag.Bool("exit-code", false, "make status exit with 2 when migrations are pending and 3 when applied ones are missing from the source")
+	limit            = flag.Int("limit", 10, "number of most recent migrations that status shows (0 shows all)")
+	offset           = flag.Int("offset", 0, "number of most recent migrations that status skips")
+	groupBy          = flag.String("group-by", "", "group status by the `day` or week migrations were applied")
+	gitAdd           = flag.Bool("git", false, "make new and generate stage the created files with git add")
+	labelRequired    = flag.Bool("label-required", false, "make new fail when no migration name is given")
+	errorsJSON       = flag.Bool("errors-as-json", false, "report failures as a JSON object on stderr")
+	onConflict       = flag.String("on-conflict", "error", "what to do when registering an already registered migration: `error` or ignore")
+	allowOutOfOrder  = flag.Bool("allow-out-of-order", false, "let up apply migrations older than the latest applied one")
+	execRole         = flag.String("role", "", "`role` to run migration scripts as, unless they name one with a fly:role directive")
+	confirmChecksum  = flag.Bool("confirm-checksum", false, "make up ask whether to accept applied migrations whose file changed, instead of warning")
+	allowDestructive = flag.Bool("allow-destructive", false, "let up apply migrations with destructive statements without asking")
+	safeMode         = flag.Bool("safe", false, "make up refuse migrations that are not purely additive, see README")
+	lockTimeout      = flag.Duration("lock-timeout", 0, "how long each statement of a migration waits for a lock, on Postgres (0 means forever)")
+	stmtRetries      = flag.Int("stmt-retries", 0, "how many times to retry a statement that hit the lock timeout, see README")
+	noRegister       = flag.Bool("no-register", false, "make apply run the script without recording the migration as applied")
+	checksumDown     = flag.Bool("checksum-down", false, "compute migration checksums over the up and the down file, see README")
+	dryRun           = flag.Bool("dry-run", false, "make up and down print the scripts they run and roll everything back")
+	singleTx         = flag.Bool("single-transaction", false, "make up apply all pending migrations in one transaction, all or nothing")
+	targetID         = flag.String("to", "", "migration `id` that up and down stop at: up applies it, down keeps it")
+	jsonOutput       = flag.Bool("json", false, "make status and version print JSON instead of a table")
+	verbose          = flag.Bool("verbose", false, "log each statement before running it, and the transaction and lock boundaries")
+	downAll          = flag.Bool("all", false, "make down roll back every applied migration")
+	yes              = flag.Bool("yes", false, "make down -all proceed without asking, and confirm repair")
+	expandEnv        = flag.Bool("expand-env", false, "replace ${VAR} and $VAR in scripts with the values of environment variables before running them")
+	statusCheck      = flag.Bool("check", false, "make status print a one-line summary instead of the table, and exit with 1 when migrations are pending or missing")
+	continueOnError  = flag.Bool("continue-on-error", false, "make up try every pending migration even after one fails, and report the failures at the end")
+	quiet            = flag.Bool("quiet", false, "make version print the bare migration ID")
+	undo             = flag.Bool("undo", false, "make force mark the migration as not applied")
+	noSplit          = flag.Bool("no-split", false, "run each migration script with a single Exec instead of statement by statement")
+	isolation        = flag.String("isolation", "", "isolation `level` of migration transactions (read committed, repeatable read or serializable)")
+	readonlyCheck    = flag.Bool("readonly-check", false, "make up run each pending script in a read-only transaction, without applying anything, to report the ones that write")
+	strict           = flag.Bool("strict", false, "fail instead of warning when a request can only be partly satisfied")
+	checkDown        = flag.Bool("check-down", false, "make down also refuse empty down scripts before rolling anything back, not only missing ones")
+	statusWatch      = flag.Bool("watch", false, "make status redraw itself every watch-interval until interrupted")
+	watchInterval    = flag.Duration("watch-interval", time.Second, "how often watch checks the source directory for changes and status -watch refreshes")
+	backupDir        = flag.String("pre-apply-backup", "", "`dir`ectory where up stores a pg_dump of the database before applying migrations")
+
+	seedSkipUnchanged = flag.Bool("seed-skip-unchanged", false, "skip seed files whose content has not changed since they last ran")
+)
+
+func doInit(db *sql.DB) error {
+	if err := initMigrationTable(db, *migrationTable); err != nil {
 		return err
 	}
-	for _, id := range migrations {
-		ok, err := isMigrationApplied(db, id)
+	return nil
+}
+
+func doStatus(db *sql.DB) error {
+	if *groupBy != "" && *groupBy != "day" && *groupBy != "week" {
+		return fmt.Errorf("invalid -group-by %q: want day or week", *groupBy)
+	}
+
+	table := *migrationTable
+	fsys, err := migrationFS()
+	if *statusCheck {
 		if err != nil {
 			return err
 		}
-		if ok {
-			continue
-		}
-		if err := runScript(tx, *sourcedir+"/"+id+".up.sql"); err != nil {
+		return checkStatus(db, fsys, table)
+	}
+	// Without a source, the applied migrations are listed all the same.
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("warning: pending migrations not shown: %v", err)
+	} else if err != nil {
+		return err
+	}
+	if *statusWatch {
+		watchStatus(db, fsys, table)
+	}
+	if err := printStatus(db, fsys, table); err != nil {
+		return err
+	}
+
+	if *exitCode {
+		if fsys == nil {
 			return err
 		}
-		if err := registerMigration(tx, id); err != nil {
+		pending, missing, err := compareMigrations(db, fsys, table)
+		if err != nil {
 			return err
 		}
-		fmt.Println("up", id)
-	}
-
-	if err := tx.Commit(); err != nil {
-		return err
+		if len(missing) > 0 {
+			return &exitError{3, fmt.Sprintf("%d applied migration(s) missing from the source", len(missing))}
+		}
+		if len(pending) > 0 {
+			return &exitError{2, fmt.Sprintf("%d pending migration(s)", len(pending))}
+		}
 	}
 
 	return nil
 }
 
-func doDown() error {
-	db, err := sql.Open("postgres", "")
+// checkStatus summarizes the pending and missing migrations in one line, and
+// fails if there are any.
+func checkStatus(db *sql.DB, fsys fs.FS, table string) error {
+	pending, missing, err := compareMigrations(db, fsys, table)
 	if err != nil {
 		return err
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+	summary := fmt.Sprintf("%d pending migration(s)", len(pending))
+	if len(missing) > 0 {
+		summary += fmt.Sprintf(", %d applied migration(s) missing from the source", len(missing))
 	}
-	defer tx.Rollback()
+	if len(pending) > 0 || len(missing) > 0 {
+		return &exitError{1, summary}
+	}
+	fmt.Println(summary)
+	return nil
+}
 
-	n := 1
-	if arg := flag.Arg(1); arg != "" {
-		var err error
-		n, err = strconv.Atoi(arg)
+// watchStatus redraws the status every -watch-interval, until fly is interrupted.
+func watchStatus(db *sql.DB, fsys fs.FS, table string) {
+	for ; ; time.Sleep(*watchInterval) {
+		fmt.Print("\033[H\033[2J")
+		if err := printStatus(db, fsys, table); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if fsys == nil {
+			continue
+		}
+		pending, _, err := compareMigrations(db, fsys, table)
 		if err != nil {
-			return err
+			fmt.Println(err)
+			continue
 		}
+		fmt.Printf("\n%d pending, updated %s\n", len(pending), time.Now().Format(time.TimeOnly))
 	}
-	_ = n
+}
 
-	migrations, err := listAppliedMigrations(db)
+// printStatus prints the table of applied migrations, limited to the page
+// selected by -limit and -offset, followed by the pending ones of fsys. Applied
+// migrations whose file is gone are marked missing. A nil fsys shows the
+// applied migrations only.
+func printStatus(db *sql.DB, fsys fs.FS, table string) error {
+	migrations, total, err := listRecentMigrations(db, table, *limit, *offset)
 	if err != nil {
 		return err
 	}
-	for i := 0; i < n; i++ {
-		j := len(migrations) - 1 - i
-		if j < 0 {
-			break
+	var pending, missing []string
+	if fsys != nil {
+		pending, missing, err = compareMigrations(db, fsys, table)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("warning: pending migrations not shown: %v", err)
+	} else if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		return printStatusJSON(fsys, migrations, pending, missing)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 1, 3, 1, ' ', 0)
+	format := "%s\t%s\t%s\t%s\t%s\t%s\n"
+	fmt.Fprintf(writer, format, "ID", "STATUS", "APPLIED", "BY", "DURATION", "DESCRIPTION")
+	fmt.Fprintf(writer, format, "--", "------", "-------", "--", "--------", "-----------")
+	if *offset+len(migrations) < total {
+		fmt.Fprintf(writer, format, "...", "...", "...", "...", "...", "...")
+	}
+	for i, m := range migrations {
+		if key := groupKey(m.applied); *groupBy != "" && (i == 0 || key != groupKey(migrations[i-1].applied)) {
+			n := 0
+			for _, next := range migrations[i:] {
+				if groupKey(next.applied) != key {
+					break
+				}
+				n++
+			}
+			fmt.Fprintf(writer, format, "["+key+"]", "", fmt.Sprintf("%d migration(s)", n), "", "", "")
 		}
-		id := migrations[j].id
-		filename := fmt.Sprintf("%s/%s.down.sql", *sourcedir, id)
-		if err := runScript(tx, filename); err != nil {
-			return err
+		state := "applied"
+		if slices.Contains(missing, m.id) {
+			state = "missing"
 		}
-		if err := unregisterMigration(tx, id); err != nil {
-			return err
+		by, duration := "-", "-"
+		if m.appliedBy.Valid {
+			by = m.appliedBy.String
 		}
-		fmt.Println("down", id)
+		if m.duration.Valid {
+			duration = (time.Duration(m.duration.Int64) * time.Millisecond).String()
+		}
+		fmt.Fprintf(writer, format, m.id, state, m.applied.Format(time.DateTime), by, duration, migrationDescription(fsys, m.id))
 	}
-
-	if err := tx.Commit(); err != nil {
+	if *offset > 0 && len(migrations) > 0 {
+		fmt.Fprintf(writer, format, "...", "...", "...", "...", "...", "...")
+	}
+	if *offset == 0 {
+		// Pending migrations come after the most recent page only.
+		for _, id := range pending {
+			fmt.Fprintf(writer, format, id, "pending", "-", "-", "-", migrationDescription(fsys, id))
+		}
+	}
+	if err := writer.Flush(); err != nil {
 		return err
 	}
-
+	if len(migrations) < total {
+		fmt.Printf("\nshowing %d of %d applied migrations (use -limit and -offset to see more)\n", len(migrations), total)
+	}
 	return nil
 }
 
-func main() {
-	log.SetFlags(0)
-	log.SetPrefix("fly: ")
-
-	flag.Parse()
+// migrationJSON is a migration as printed by -json. Applied and the fields
+// after it are null for pending migrations.
+type migrationJSON struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Applied     *time.Time `json:"applied"`
+	AppliedBy   *string    `json:"applied_by"`
+	Duration    *int64     `json:"duration_ms"`
+	Description string     `json:"description"`
+}
 
-	if flag.NArg() < 1 {
-		log.Fatal("usage: fly <command>")
+func newMigrationJSON(m migration, status string) migrationJSON {
+	j := migrationJSON{ID: m.id, Status: status, Applied: &m.applied}
+	if m.appliedBy.Valid {
+		j.AppliedBy = &m.appliedBy.String
+	}
+	if m.duration.Valid {
+		j.Duration = &m.duration.Int64
 	}
+	return j
+}
 
-	var (
+// printStatusJSON prints the rows of printStatus as a JSON array.
+func printStatusJSON(fsys fs.FS, migrations []migration, pending, missing []string) error {
+	rows := []migrationJSON{}
+	for _, m := range migrations {
+		state := "applied"
+		if slices.Contains(missing, m.id) {
+			state = "missing"
+		}
+		row := newMigrationJSON(m, state)
+		row.Description = migrationDescription(fsys, m.id)
+		rows = append(rows, row)
+	}
+	if *offset == 0 {
+		for _, id := range pending {
+			rows = append(rows, migrationJSON{ID: id, Status: "pending", Description: migrationDescription(fsys, id)})
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
+
+// groupKey returns the label of the -group-by bucket that t falls into.
+func groupKey(t time.Time) string {
+	if *groupBy == "week" {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	return t.Format(time.DateOnly)
+}
+
+// doVersion prints the most recently applied migration.
+func doVersion(db *sql.DB) error {
+	migrations, _, err := listRecentMigrations(db, *migrationTable, 1, 0)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		var current *migrationJSON
+		if len(migrations) > 0 {
+			j := newMigrationJSON(migrations[0], "applied")
+			if fsys, err := migrationFS(); err == nil {
+				j.Description = migrationDescription(fsys, j.ID)
+			}
+			current = &j
+		}
+		return json.NewEncoder(os.Stdout).Encode(current)
+	}
+	if len(migrations) == 0 {
+		fmt.Println("none")
+		return nil
+	}
+	m := migrations[0]
+	if *quiet {
+		fmt.Println(m.id)
+		return nil
+	}
+	fmt.Println(m.id, m.applied.Format(time.DateTime))
+	return nil
+}
+
+func doNew() error {
+	label := flag.Arg(1)
+	if label == "" {
+		if *labelRequired {
+			return errors.New("missing migration name")
+		}
+		label = "unnamed"
+	}
+	id, err := createMigration(label, nil, nil)
+	if err != nil {
+		return err
+	}
+	stageMigration(id)
+	return nil
+}
+
+// stageMigration adds the files of a new migration to the git index, with
+// -git.
+func stageMigration(id string) {
+	if !*gitAdd {
+		return
+	}
+	cmd := exec.Command("git", "add", *sourcedir+"/"+id+".up.sql", *sourcedir+"/"+id+".down.sql")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("warning: could not stage %s: %v: %s", id, err, bytes.TrimSpace(out))
+	}
+}
+
+// createMigration writes the up and down files of a new migration with the
+// next serial and the given label, and returns the ID of the migration.
+func createMigration(label string, up, down []byte) (string, error) {
+	if *sourceArchive != "" || useEmbedded() {
+		return "", errors.New("cannot create a migration in a read-only source: new only writes to -sourcedir")
+	}
+	// The first migration of a project may come before its directory.
+	if err := os.MkdirAll(*sourcedir, 0777); err != nil {
+		return "", err
+	}
+	fsys, err := migrationFS()
+	if err != nil {
+		return "", err
+	}
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return "", err
+	}
+	label = strings.ReplaceAll(label, " ", "_")
+	var id string
+	switch *idFormat {
+	case "serial":
+		last := ""
+		if len(migrations) > 0 {
+			last = migrations[len(migrations)-1]
+		}
+		id, err = nextID(last, label)
+		if err != nil {
+			return "", err
+		}
+	case "date-serial":
+		id = nextDateID(migrations, label, time.Now().UTC())
+	case "timestamp":
+		id = time.Now().UTC().Format("20060102150405") + "_" + label
+		if slices.ContainsFunc(migrations, func(m string) bool { return strings.HasPrefix(m, id[:15]) }) {
+			return "", fmt.Errorf("a migration was already created at %s: try again in a second", id[:14])
+		}
+	default:
+		return "", fmt.Errorf("invalid -id-format %q: want serial, date-serial or timestamp", *idFormat)
+	}
+	if err := os.WriteFile(*sourcedir+"/"+id+".up.sql", up, 0666); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(*sourcedir+"/"+id+".down.sql", down, 0666); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// backupDatabase writes a logical backup of the database into dir using pg_dump.
+func backupDatabase(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("%s/fly-%s.sql", dir, time.Now().Format("20060102150405"))
+	args := []string{"-f", filename}
+	if dsn := targetDSN(); dsn != "" {
+		args = append(args, "-d", dsn)
+	}
+	cmd := exec.Command("pg_dump", args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not back up database: %v", err)
+	}
+	fmt.Println("backup", filename)
+	return nil
+}
+
+func doUp(db *sql.DB) error {
+	n := 0
+	if arg := flag.Arg(1); arg != "" {
+		if *targetID != "" {
+			return errors.New("up takes either a count or -to, not both")
+		}
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return errors.New("usage: fly up [n], with n at least 1")
+		}
+	}
+
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	table := *migrationTable
+
+	if *backupDir != "" && !*dryRun {
+		if err := backupDatabase(*backupDir); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+	if *schemaPattern != "" {
+		if *schemaName != "" {
+			return errors.New("up takes either -schema or -schemas, not both")
+		}
+		return interrupted(ctx, upSchemas(ctx, db, fsys, table, *schemaPattern, n))
+	}
+	release, err := migrationLock(ctx, db, table)
+	if err != nil {
+		return interrupted(ctx, err)
+	}
+	defer release()
+	before := 0
+	if *lockfile != "" && !*dryRun {
+		applied, err := listAppliedMigrations(db, table)
+		if err != nil {
+			return err
+		}
+		before = len(applied)
+	}
+	if err := up(ctx, db, fsys, table, n); err != nil {
+		// The migrations committed before the failure stay applied, and
+		// the lockfile must list them.
+		if *lockfile != "" && !*dryRun {
+			if applied, lerr := listAppliedMigrations(db, table); lerr == nil && len(applied) > before {
+				if lerr := writeLockfile(db, table); lerr != nil {
+					log.Printf("warning: could not update %s: %v", *lockfile, lerr)
+				}
+			}
+		}
+		return interrupted(ctx, err)
+	}
+	if *dryRun {
+		return nil
+	}
+	return writeLockfile(db, table)
+}
+
+// checkTarget checks that the migration given with -to, if any, exists.
+func checkTarget(fsys fs.FS) error {
+	if *targetID == "" {
+		return nil
+	}
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(migrations, *targetID) {
+		return fmt.Errorf("unknown migration %s given with -to", *targetID)
+	}
+	return nil
+}
+
+// up applies the first n pending migrations of fsys to the database, or all of
+// them when n is 0, and registers them in the migration table.
+func up(ctx context.Context, db *sql.DB, fsys fs.FS, table string, n int) error {
+	migrations, err := pendingMigrations(db, fsys, table)
+	if err != nil {
+		return err
+	}
+	if n > 0 && n < len(migrations) {
+		migrations = migrations[:n]
+	}
+	if *targetID != "" {
+		if err := checkTarget(fsys); err != nil {
+			return err
+		}
+		i := slices.IndexFunc(migrations, func(id string) bool { return compareIDs(id, *targetID) > 0 })
+		if i >= 0 {
+			migrations = migrations[:i]
+		}
+	}
+	if *readonlyCheck {
+		return checkReadOnly(db, fsys, migrations)
+	}
+	if err := checkOrder(db, table, migrations); err != nil {
+		return err
+	}
+	if *safeMode {
+		if err := checkSafe(fsys, migrations); err != nil {
+			return err
+		}
+	}
+	if err := checkDestructive(ctx, fsys, migrations); err != nil {
+		return err
+	}
+	problems, err := irreversible(fsys, migrations)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		log.Printf("warning: applying irreversible migrations: %s", strings.Join(problems, ", "))
+	}
+
+	if *continueOnError && (*singleTx || *dryRun || *parallel > 1) {
+		return errors.New("-continue-on-error cannot be combined with -single-transaction, -dry-run or -parallel")
+	}
+	if !*singleTx && !*dryRun {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := reconcileChecksums(ctx, db, tx, fsys, table); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if *parallel > 1 {
+			return upParallel(ctx, db, fsys, table, migrations)
+		}
+		if *continueOnError {
+			return upEach(ctx, db, fsys, table, migrations)
+		}
+		// A failed migration stops the ones after it; those before it stay applied.
+		for _, id := range migrations {
+			if err := applyOne(ctx, db, fsys, table, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	isolation, err := migrationIsolation(fsys, migrations)
+	if err != nil {
+		return err
+	}
+	verbosef("begin transaction")
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: isolation})
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+
+	if err := reconcileChecksums(ctx, db, tx, fsys, table); err != nil {
+		return err
+	}
+	for _, id := range migrations {
+		noTx, err := noTransaction(fsys, id)
+		if err != nil {
+			return err
+		}
+		b, batched, err := batchOf(fsys, id)
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			if err := printScript(fsys, id+".up.sql"); err != nil {
+				return err
+			}
+		}
+		if (noTx || batched) && *dryRun {
+			log.Printf("dry run: not running %s, which cannot be rolled back", id)
+			continue
+		}
+		if noTx || batched {
+			// The migrations before it are committed first, and the
+			// ones after it get a new transaction.
+			verbosef("commit")
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			apply := func() error { return applyWithoutTx(ctx, db, fsys, table, id) }
+			if batched {
+				apply = func() error { return applyBatched(ctx, db, fsys, table, id, b) }
+			}
+			if err := step("up", id, apply); err != nil {
+				return err
+			}
+			verbosef("begin transaction")
+			tx, err = db.BeginTx(ctx, &sql.TxOptions{Isolation: isolation})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = step("up", id, func() error { return applyInTx(ctx, tx, fsys, table, id) })
+		if err != nil {
+			return err
+		}
+	}
+
+	if *dryRun {
+		return tx.Rollback()
+	}
+	verbosef("commit")
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// upEach applies the pending migrations one by one, each in its own
+// transaction, going on after a failure. It then lists the migrations that
+// were applied and those that failed.
+func upEach(ctx context.Context, db *sql.DB, fsys fs.FS, table string, migrations []string) error {
+	var applied, failed []string
+	for _, id := range migrations {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := applyOne(ctx, db, fsys, table, id); err != nil {
+			log.Printf("%s: %v", id, err)
+			failed = append(failed, id)
+			continue
+		}
+		applied = append(applied, id)
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	fmt.Printf("\napplied: %d\n", len(applied))
+	for _, id := range applied {
+		fmt.Println("  " + id)
+	}
+	fmt.Printf("failed: %d\n", len(failed))
+	for _, id := range failed {
+		fmt.Println("  " + id)
+	}
+	return fmt.Errorf("%d of %d migrations failed", len(failed), len(applied)+len(failed))
+}
+
+// printScript prints a migration file for -dry-run.
+func printScript(fsys fs.FS, filename string) error {
+	script, err := fs.ReadFile(fsys, filename)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("-- %s\n%s\n", filename, bytes.TrimRight(script, "\n"))
+	return nil
+}
+
+// doApply applies a single migration, whatever its position, following its
+// directives as up does. With -no-register the script is run but the
+// migration is not recorded, so that it can be run again while it is being
+// written; this is refused for migrations that do not run in a transaction.
+func doApply(db *sql.DB) error {
+	id := flag.Arg(1)
+	if id == "" {
+		return errors.New("usage: fly apply <id>")
+	}
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	table := *migrationTable
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(migrations, id) {
+		return fmt.Errorf("unknown migration %s", id)
+	}
+	if *noRegister {
+		// A migration that does not run in a single transaction would
+		// leave progress behind that nothing clears.
+		noTx, err := noTransaction(fsys, id)
+		if err != nil {
+			return err
+		}
+		_, batched, err := batchOf(fsys, id)
+		if err != nil {
+			return err
+		}
+		if noTx || batched {
+			return fmt.Errorf("cannot apply %s with -no-register: it does not run in a transaction", id)
+		}
+	}
+
+	ctx := context.Background()
+	release, err := migrationLock(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if *noRegister {
+		log.Printf("warning: %s is not recorded as applied; fly will not know about its changes", id)
+	} else {
+		applied, err := isMigrationApplied(db, table, id)
+		if err != nil {
+			return err
+		}
+		if applied {
+			return fmt.Errorf("migration %s is already applied", id)
+		}
+	}
+
+	if !*noRegister {
+		if err := applyOne(ctx, db, fsys, table, id); err != nil {
+			return err
+		}
+		return writeLockfile(db, table)
+	}
+
+	isolation, err := migrationIsolation(fsys, []string{id})
+	if err != nil {
+		return err
+	}
+	verbosef("begin transaction")
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: isolation})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = step("up", id, func() error { return runScript(ctx, tx, fsys, id+".up.sql") })
+	if err != nil {
+		return err
+	}
+	verbosef("commit")
+	return tx.Commit()
+}
+
+func doDown(db *sql.DB) error {
+	level, err := parseIsolation(*isolation)
+	if err != nil {
+		return err
+	}
+	table := *migrationTable
+	release, err := migrationLock(context.Background(), db, table)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	n := 1
+	all := *downAll || flag.Arg(1) == "all"
+	if arg := flag.Arg(1); arg != "" || all {
+		if *targetID != "" || (*downAll && arg != "") {
+			return errors.New("down takes either a count, -to or -all, not several")
+		}
+		if !all {
+			var err error
+			n, err = strconv.Atoi(arg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	if err := checkTarget(fsys); err != nil {
+		return err
+	}
+	migrations, err := listAppliedMigrations(db, table)
+	if err != nil {
+		return err
+	}
+	if *targetID != "" {
+		i := slices.IndexFunc(migrations, func(m migration) bool { return m.id == *targetID })
+		if i < 0 {
+			return fmt.Errorf("cannot go down to %s: it is not applied", *targetID)
+		}
+		n = len(migrations) - 1 - i
+	}
+	if all {
+		n = len(migrations)
+		if err := confirmDownAll(n); err != nil {
+			return err
+		}
+	}
+	var targets []string
+	for i := 0; i < n && i < len(migrations); i++ {
+		targets = append(targets, migrations[len(migrations)-1-i].id)
+	}
+	short := ""
+	if n > len(targets) {
+		short = fmt.Sprintf("requested %d, only %d applied", n, len(targets))
+		if *strict {
+			return errors.New(short)
+		}
+	}
+	// Missing down scripts are reported before anything is rolled back;
+	// -check-down also looks into the scripts.
+	check := checkDownFiles
+	if *checkDown {
+		check = checkDownScripts
+	}
+	if err := check(fsys, targets); err != nil {
+		return err
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+	if err := down(ctx, db, fsys, table, targets, level); err != nil {
+		return interrupted(ctx, err)
+	}
+	if *dryRun {
+		return nil
+	}
+	if short != "" {
+		log.Printf("%s; rolled back %d", short, len(targets))
+	}
+
+	return writeLockfile(db, table)
+}
+
+// down runs the down scripts of the targets, in order, in a single
+// transaction with the given isolation level, and unregisters them from the
+// migration table.
+func down(ctx context.Context, db *sql.DB, fsys fs.FS, table string, targets []string, level sql.IsolationLevel) error {
+	verbosef("begin transaction")
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range targets {
+		if *dryRun {
+			if err := printScript(fsys, id+".down.sql"); err != nil {
+				return err
+			}
+		}
+		err := step("down", id, func() error {
+			if err := runScript(ctx, tx, fsys, id+".down.sql"); err != nil {
+				return err
+			}
+			if err := verifyDown(tx, fsys, id); err != nil {
+				return err
+			}
+			return unregisterMigration(tx, table, id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if *dryRun {
+		return tx.Rollback()
+	}
+	verbosef("commit")
+	return tx.Commit()
+}
+
+// confirmDownAll asks before down -all rolls back all n applied migrations,
+// unless -yes or -dry-run is set.
+func confirmDownAll(n int) error {
+	if *yes || *dryRun || n == 0 {
+		return nil
+	}
+	if !interactive() {
+		return fmt.Errorf("refusing to roll back all %d applied migrations (use -yes)", n)
+	}
+	ok, err := confirm(context.Background(), fmt.Sprintf("roll back all %d applied migrations?", n))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("rolling back all migrations not confirmed")
+	}
+	return nil
+}
+
+// doForce records a migration as applied without running its up script, or
+// with -undo as not applied without running its down script, to recover from
+// a migration that was completed or undone by hand.
+func doForce(db *sql.DB) error {
+	id := flag.Arg(1)
+	if id == "" {
+		return errors.New("usage: fly force [-undo] <id>")
+	}
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	table := *migrationTable
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(migrations, id) {
+		return fmt.Errorf("unknown migration %s", id)
+	}
+
+	release, err := migrationLock(context.Background(), db, table)
+	if err != nil {
+		return err
+	}
+	defer release()
+	applied, err := isMigrationApplied(db, table, id)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if *undo {
+		if !applied {
+			return fmt.Errorf("migration %s is not applied", id)
+		}
+		if err := unregisterMigration(tx, table, id); err != nil {
+			return err
+		}
+	} else {
+		if applied {
+			return fmt.Errorf("migration %s is already applied", id)
+		}
+		sum, err := migrationChecksum(fsys, id)
+		if err != nil {
+			return err
+		}
+		if err := registerMigration(tx, table, id, sum, 0); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if *undo {
+		fmt.Println("marked not applied", id)
+	} else {
+		fmt.Println("marked applied", id)
+	}
+	return writeLockfile(db, table)
+}
+
+// doBaseline adopts fly on a database whose schema already matches the
+// migrations up to the given one: it records them as applied without running
+// them. A migration table with any history is left alone.
+func doBaseline(db *sql.DB) error {
+	target := flag.Arg(1)
+	if target == "" {
+		return errors.New("usage: fly baseline <id>")
+	}
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	table := *migrationTable
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	i := slices.Index(migrations, target)
+	if i < 0 {
+		return fmt.Errorf("unknown migration %s", target)
+	}
+
+	release, err := migrationLock(context.Background(), db, table)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := initMigrationTable(db, table); err != nil {
+		return err
+	}
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM " + table).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("refusing to baseline: %d migration(s) already recorded", count)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range migrations[:i+1] {
+		sum, err := migrationChecksum(fsys, id)
+		if err != nil {
+			return err
+		}
+		if err := registerMigration(tx, table, id, sum, 0); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("baseline %s: %d migration(s) marked applied\n", target, i+1)
+	return writeLockfile(db, table)
+}
+
+// doRedo rolls back the most recent migration, or the n most recent ones, and
+// applies them again, all in one transaction: if anything fails, the database
+// is left as it was.
+func doRedo(db *sql.DB) error {
+	n := 1
+	if arg := flag.Arg(1); arg != "" {
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return errors.New("usage: fly redo [n], with n at least 1")
+		}
+	}
+
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	table := *migrationTable
+	release, err := migrationLock(context.Background(), db, table)
+	if err != nil {
+		return err
+	}
+	defer release()
+	migrations, err := listAppliedMigrations(db, table)
+	if err != nil {
+		return err
+	}
+	if n > len(migrations) {
+		return fmt.Errorf("requested %d, only %d applied", n, len(migrations))
+	}
+	targets := make([]string, n)
+	for i := range targets {
+		targets[i] = migrations[len(migrations)-n+i].id
+	}
+	for _, id := range targets {
+		noTx, err := noTransaction(fsys, id)
+		if err != nil {
+			return err
+		}
+		_, batched, err := batchOf(fsys, id)
+		if err != nil {
+			return err
+		}
+		if noTx || batched {
+			return fmt.Errorf("cannot redo %s: it does not run in a transaction", id)
+		}
+	}
+
+	isolation, err := migrationIsolation(fsys, targets)
+	if err != nil {
+		return err
+	}
+	verbosef("begin transaction")
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: isolation})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range slices.Backward(targets) {
+		err := step("down", id, func() error {
+			if err := runScript(context.Background(), tx, fsys, id+".down.sql"); err != nil {
+				return err
+			}
+			if err := verifyDown(tx, fsys, id); err != nil {
+				return err
+			}
+			return unregisterMigration(tx, table, id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range targets {
+		err := step("up", id, func() error { return applyInTx(context.Background(), tx, fsys, table, id) })
+		if err != nil {
+			return err
+		}
+	}
+	verbosef("commit")
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return writeLockfile(db, table)
+}
+
+// verifyDown runs the query of the fly:verify-down directive of the down
+// script, if any. The rollback fails unless the query returns a row whose
+// first column is not false.
+func verifyDown(tx *sql.Tx, fsys fs.FS, migration string) error {
+	script, err := fs.ReadFile(fsys, migration+".down.sql")
+	if err != nil {
+		return err
+	}
+	query, ok := directives(string(script))["verify-down"]
+	if !ok {
+		return nil
+	}
+
+	rows, err := tx.Query(query)
+	if err != nil {
+		return fmt.Errorf("could not verify rollback of %s: %v", migration, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("could not verify rollback of %s: %v", migration, err)
+		}
+		return fmt.Errorf("rollback of %s not verified: %s returned no rows", migration, query)
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	// A row without columns, as from SELECT FROM t WHERE ..., has no
+	// first column that could be false.
+	if len(cols) == 0 {
+		return rows.Close()
+	}
+	values := make([]any, len(cols))
+	for i := range values {
+		values[i] = new(any)
+	}
+	if err := rows.Scan(values...); err != nil {
+		return err
+	}
+	if v, ok := (*values[0].(*any)).(bool); ok && !v {
+		return fmt.Errorf("rollback of %s not verified: %s returned false", migration, query)
+	}
+	return rows.Close()
+}
+
+// checkDownFiles verifies that every migration has a down script, listing all
+// the missing ones.
+func checkDownFiles(fsys fs.FS, migrations []string) error {
+	var missing []string
+	for _, id := range migrations {
+		_, err := fs.Stat(fsys, id+".down.sql")
+		if errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, id+".down.sql")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cannot roll back: missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkDownScripts verifies that every migration has a down script with at
+// least one statement, reporting all the migrations that cannot be rolled back.
+func checkDownScripts(fsys fs.FS, migrations []string) error {
+	problems, err := irreversible(fsys, migrations)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("cannot roll back: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// irreversible describes the migrations whose down script is missing or has no statements.
+func irreversible(fsys fs.FS, migrations []string) ([]string, error) {
+	var problems []string
+	for _, id := range migrations {
+		script, err := fs.ReadFile(fsys, id+".down.sql")
+		if errors.Is(err, fs.ErrNotExist) {
+			problems = append(problems, id+".down.sql is missing")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(splitStatements(string(script))) == 0 {
+			problems = append(problems, id+".down.sql is empty")
+		}
+	}
+	return problems, nil
+}
+
+func doVerifyChecksums(db *sql.DB) error {
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	migrations, err := listAppliedMigrations(db, *migrationTable)
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, m := range migrations {
+		sum, err := migrationChecksum(fsys, m.id)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			fmt.Println("missing", m.id)
+			problems++
+		case err != nil:
+			return err
+		case !m.checksum.Valid:
+			fmt.Println("unverified", m.id)
+		case m.checksum.String != sum:
+			fmt.Println("mismatch", m.id)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d applied migration(s) differ from the source", problems)
+	}
+	return nil
+}
+
+func doSeed(db *sql.DB) error {
+	table := *migrationTable
+	fsys := os.DirFS(*seeddir)
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	var seeds []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".sql") {
+			seeds = append(seeds, e.Name())
+		}
+	}
+	sort.Strings(seeds)
+
+	sums := make(map[string]string)
+	for _, name := range seeds {
+		script, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if ddl := findDDL(string(script)); len(ddl) > 0 {
+			if *seedStrict {
+				return fmt.Errorf("seed %s contains schema changes: %s", name, ddl[0])
+			}
+			log.Printf("warning: seed %s contains schema changes; they belong in a migration", name)
+		}
+		sums[name] = checksum(script)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	d := sqlDialect()
+	if *seedSkipUnchanged {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS " + seedTable(table) + " (name VARCHAR(256) PRIMARY KEY, checksum CHAR(64), applied " + d.timestamp + " DEFAULT CURRENT_TIMESTAMP)")
+		if err != nil {
+			return fmt.Errorf("could not create seed table: %v", err)
+		}
+	}
+
+	for _, name := range seeds {
+		if *seedSkipUnchanged {
+			var last string
+			err := tx.QueryRow(d.bind("SELECT checksum FROM "+seedTable(table)+" WHERE name = $1"), name).Scan(&last)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("could not check seed %s: %v", name, err)
+			}
+			if last == sums[name] {
+				fmt.Println("unchanged", name)
+				continue
+			}
+		}
+		if err := runScript(context.Background(), tx, fsys, name); err != nil {
+			return err
+		}
+		if *seedSkipUnchanged {
+			query := d.upsert("INSERT INTO "+seedTable(table)+" (name, checksum, applied) VALUES ($1, $2, CURRENT_TIMESTAMP)", "name", "checksum", "applied")
+			_, err := tx.Exec(d.bind(query), name, sums[name])
+			if err != nil {
+				return fmt.Errorf("could not record seed %s: %v", name, err)
+			}
+		}
+		fmt.Println("seed", name)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// doVerifyAll runs every migration up, then every migration down, in a single
+// transaction on the shadow database, and rolls it all back. Migrations that
+// do not run in a transaction (fly:no-transaction, batches) are skipped, with
+// a warning, as they could not be rolled back.
+func doVerifyAll(db *sql.DB) error {
+	if *shadowDSN == "" {
+		return errors.New("verify-all requires -shadow-dsn")
+	}
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	all, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	var migrations []string
+	for _, id := range all {
+		noTx, err := noTransaction(fsys, id)
+		if err != nil {
+			return err
+		}
+		_, batched, err := batchOf(fsys, id)
+		if err != nil {
+			return err
+		}
+		if noTx || batched {
+			log.Printf("warning: not verifying %s: it does not run in a transaction", id)
+			continue
+		}
+		migrations = append(migrations, id)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range migrations {
+		if err := runScript(context.Background(), tx, fsys, id+".up.sql"); err != nil {
+			return fmt.Errorf("up %s: %v", id, err)
+		}
+		fmt.Println("up", id)
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		id := migrations[i]
+		if err := runScript(context.Background(), tx, fsys, id+".down.sql"); err != nil {
+			return fmt.Errorf("down %s: %v", id, err)
+		}
+		fmt.Println("down", id)
+	}
+
+	// The shadow database is left as it was found.
+	return nil
+}
+
+func doWatch(db *sql.DB) error {
+	if *sourceArchive != "" {
+		return errors.New("cannot watch a -source archive")
+	}
+
+	// Changes are applied once the directory has looked the same for a
+	// whole interval, so that editors saving in several steps are not caught
+	// halfway.
+	var prev, applied string
+	for ; ; time.Sleep(*watchInterval) {
+		snap, err := snapshotDir(*sourcedir)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if snap == prev && snap != applied {
+			if err := doUp(db); err != nil {
+				log.Print(err)
+			}
+			applied = snap
+		}
+		prev = snap
+	}
+}
+
+// snapshotDir describes the up files in dir, so that any change to them changes the result.
+func snapshotDir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".up.sql") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(&b, e.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// command is a fly command, run by name.
+type command struct {
+	name    string
+	summary string
+	run     func() error
+}
+
+var commands []command
+
+func init() {
+	// Assigned here rather than in the declaration, because the completion
+	// command needs to list the commands themselves.
+	commands = []command{
+		{"init", "create metadata structures", withDB(doInit)},
+		{"setup", "write the connection settings to the config file", doSetup},
+		{"baseline", "mark the migrations up to an existing schema as applied", withDB(doBaseline)},
+		{"check-perms", "check that the role has the privileges fly needs", withDB(doCheckPerms)},
+		{"status", "get list of applied migrations", withDB(doStatus)},
+		{"version", "print the most recently applied migration", withDB(doVersion)},
+		{"list", "list the migrations of the source and the database with their state", withDB(doList)},
+		{"new", "create new migration", doNew},
+		{"generate", "create a migration from a template, such as create-table", doGenerate},
+		{"up", "apply all migrations", withDB(doUp)},
+		{"down", "undo the most recent migrations", withDB(doDown)},
+		{"apply", "apply a single migration", withDB(doApply)},
+		{"redo", "undo and apply again the most recent migrations", withDB(doRedo)},
+		{"force", "mark a migration as applied, or not, without running it", withDB(doForce)},
+		{"repair", "run the down script of a failed migration that is not applied", withDB(doRepair)},
+		{"seed", "run the data seeding scripts", withDB(doSeed)},
+		{"watch", "apply migrations as files change", withDB(doWatch)},
+		{"diff-gen", "create a migration from a desired schema", withDB(doDiffGen)},
+		{"docs", "write a Markdown catalog of the migrations", doDocs},
+		{"export", "write the applied migrations as CSV", withDB(doExport)},
+		{"export-plan", "write the SQL that up would run, for psql", withDB(doExportPlan)},
+		{"verify-checksums", "check applied migrations against their files", withDB(doVerifyChecksums)},
+		{"verify", "same as verify-checksums", withDB(doVerifyChecksums)},
+		{"validate", "check the migration files for missing scripts and serials", doValidate},
+		{"verify-lock", "check the database against the lockfile", withDB(doVerifyLock)},
+		{"verify-all", "apply and roll back every migration on the shadow database", withShadowDB(doVerifyAll)},
+		{"test-reversible", "check on the shadow database that a down script reverses its up script", doTestReversible},
+		{"completion", "print a shell completion script", doCompletion},
+	}
+}
+
+// parseInterspersed parses the flags that follow the command or its arguments,
+// as in "fly status -exit-code", and leaves only the positional arguments in flag.Args.
+func parseInterspersed() {
+	var positional []string
+	for args := flag.Args(); len(args) > 0; args = flag.Args()[1:] {
+		flag.CommandLine.Parse(args)
+		if flag.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flag.Arg(0))
+	}
+	flag.CommandLine.Parse(append([]string{"--"}, positional...))
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("fly: ")
+
+	flag.Parse()
+	parseInterspersed()
+	if err := loadConfig(); err != nil {
+		fatal(flag.Arg(0), err)
+	}
+	if err := openEventLog(); err != nil {
+		fatal(flag.Arg(0), err)
+	}
+
+	if flag.NArg() < 1 {
+		fatal("", errors.New("usage: fly <command>"))
+	}
+
+	var (
 		cmd = flag.Arg(0)
-		err error
-	)
-	switch cmd {
-	case "init":
-		err = doInit()
-	case "status":
-		err = doStatus()
-	case "new":
-		err = doNew()
-	case "up":
-		err = doUp()
-	case "down":
-		err = doDown()
-	default:
 		err = errors.New("unknown cmd")
+	)
+	for _, c := range commands {
+		if c.name == cmd {
+			err = c.run()
+			break
+		}
 	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(cmd, err)
+	}
+}
+
+// fatal reports the error of the command and exits with a non-zero status.
+func fatal(cmd string, err error) {
+	code := 1
+	var xerr *exitError
+	if errors.As(err, &xerr) {
+		code = xerr.code
+	}
+	if !*errorsJSON {
+		log.Print(err)
+		os.Exit(code)
+	}
+
+	report := struct {
+		Error     string `json:"error"`
+		Command   string `json:"command"`
+		Migration string `json:"migration,omitempty"`
+	}{
+		Error:   err.Error(),
+		Command: cmd,
+	}
+	var merr *migrationError
+	if errors.As(err, &merr) {
+		report.Migration = merr.id
 	}
+	json.NewEncoder(os.Stderr).Encode(report)
+	os.Exit(code)
 }
@@ -0,0 +1,298 @@
+//go:build sqlite3
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// openFixture opens an empty SQLite database and writes the given migration
+// files into a source directory, returning both.
+func openFixture(t *testing.T, files map[string]string) (*sql.DB, string) {
+	t.Helper()
+	previous := *driver
+	*driver = "sqlite3"
+	t.Cleanup(func() { *driver = previous })
+
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "fly.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	src := filepath.Join(dir, "migrations")
+	if err := os.Mkdir(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range files {
+		writeMigration(t, src, name, script)
+	}
+	return db, src
+}
+
+func writeMigration(t *testing.T, dir, name, script string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// registered returns the IDs in the migration table, sorted.
+func registered(t *testing.T, db *sql.DB, table string) []string {
+	t.Helper()
+	applied, err := listAppliedMigrations(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range applied {
+		ids = append(ids, m.id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	err = fn()
+	os.Stdout = stdout
+	w.Close()
+	b := <-out
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUpStatusDown(t *testing.T) {
+	db, src := openFixture(t, map[string]string{
+		"0001_users.up.sql":   "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT);",
+		"0001_users.down.sql": "DROP TABLE users;",
+		"0002_posts.up.sql":   "CREATE TABLE posts (id INTEGER PRIMARY KEY, user_id INTEGER);\nINSERT INTO users (name) VALUES ('admin');",
+		"0002_posts.down.sql": "DROP TABLE posts;\nDELETE FROM users;",
+	})
+	const table = "fly_migration"
+	ctx := context.Background()
+	fsys := os.DirFS(src)
+
+	if err := initMigrationTable(db, table); err != nil {
+		t.Fatal(err)
+	}
+	if err := up(ctx, db, fsys, table, 0); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if got, want := registered(t, db, table), []string{"0001_users", "0002_posts"}; !slices.Equal(got, want) {
+		t.Errorf("after up, migration table holds %q, want %q", got, want)
+	}
+	applied, err := listAppliedMigrations(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range applied {
+		sum, err := migrationChecksum(fsys, m.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.checksum.String != sum {
+			t.Errorf("%s registered with checksum %q, want %q", m.id, m.checksum.String, sum)
+		}
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM users").Scan(&n); err != nil || n != 1 {
+		t.Errorf("users holds %d rows (%v), want 1", n, err)
+	}
+	var other int
+	db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'migration'").Scan(&other)
+	if other != 0 {
+		t.Errorf("up created the default migration table instead of using %s", table)
+	}
+
+	// A new migration is pending until the next up.
+	writeMigration(t, src, "0003_tags.up.sql", "-- Tag the posts.\nCREATE TABLE tags (name TEXT);")
+	writeMigration(t, src, "0003_tags.down.sql", "DROP TABLE tags;")
+	pending, missing, err := compareMigrations(db, fsys, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pending, []string{"0003_tags"}) || len(missing) != 0 {
+		t.Errorf("status: pending %q, missing %q, want pending [0003_tags] and none missing", pending, missing)
+	}
+	out := captureStdout(t, func() error { return printStatus(db, fsys, table) })
+	for _, want := range []string{"0001_users", "0002_posts", "0003_tags"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("status does not list %s:\n%s", want, out)
+		}
+	}
+	if !strings.Contains(out, "pending") || !strings.Contains(out, "Tag the posts.") {
+		t.Errorf("status does not show 0003_tags as pending with its description:\n%s", out)
+	}
+
+	if err := up(ctx, db, fsys, table, 1); err != nil {
+		t.Fatalf("up 1: %v", err)
+	}
+	if got, want := registered(t, db, table), []string{"0001_users", "0002_posts", "0003_tags"}; !slices.Equal(got, want) {
+		t.Errorf("after up 1, migration table holds %q, want %q", got, want)
+	}
+
+	if err := down(ctx, db, fsys, table, []string{"0003_tags", "0002_posts"}, sql.LevelDefault); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if got, want := registered(t, db, table), []string{"0001_users"}; !slices.Equal(got, want) {
+		t.Errorf("after down 2, migration table holds %q, want %q", got, want)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM users").Scan(&n); err != nil || n != 0 {
+		t.Errorf("users holds %d rows (%v) after down, want 0", n, err)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM posts").Scan(&n); err == nil {
+		t.Error("posts still exists after down")
+	}
+	pending, _, err = compareMigrations(db, fsys, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pending, []string{"0002_posts", "0003_tags"}) {
+		t.Errorf("after down, pending %q, want [0002_posts 0003_tags]", pending)
+	}
+}
+
+func TestUpStopsAtFailure(t *testing.T) {
+	db, src := openFixture(t, map[string]string{
+		"0001_a.up.sql":   "CREATE TABLE a (x INTEGER);",
+		"0001_a.down.sql": "DROP TABLE a;",
+		"0002_b.up.sql":   "INSERT INTO missing VALUES (1);",
+		"0002_b.down.sql": "SELECT 1;",
+		"0003_c.up.sql":   "CREATE TABLE c (x INTEGER);",
+		"0003_c.down.sql": "DROP TABLE c;",
+	})
+	const table = "migration"
+	fsys := os.DirFS(src)
+
+	if err := initMigrationTable(db, table); err != nil {
+		t.Fatal(err)
+	}
+	err := up(context.Background(), db, fsys, table, 0)
+	var merr *migrationError
+	if err == nil || !errors.As(err, &merr) || merr.id != "0002_b" {
+		t.Fatalf("up = %v, want the failure of 0002_b", err)
+	}
+	if got, want := registered(t, db, table), []string{"0001_a"}; !slices.Equal(got, want) {
+		t.Errorf("migration table holds %q, want %q", got, want)
+	}
+	out := captureStdout(t, func() error { return printStatus(db, fsys, table) })
+	if !strings.Contains(out, "0003_c") {
+		t.Errorf("status does not list 0003_c as pending:\n%s", out)
+	}
+}
+
+func TestAppliedOrderTies(t *testing.T) {
+	db, _ := openFixture(t, nil)
+	const table = "migration"
+	if err := initMigrationTable(db, table); err != nil {
+		t.Fatal(err)
+	}
+	// baseline and -single-transaction register migrations at the same time.
+	_, err := db.Exec(`INSERT INTO migration (id, applied) VALUES
+		('10000_b', '2024-01-02 00:00:00'),
+		('0002_x', '2024-01-01 00:00:00'),
+		('9999_a', '2024-01-02 00:00:00'),
+		('0100_c', '2024-01-02 00:00:00')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := listAppliedMigrations(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range applied {
+		ids = append(ids, m.id)
+	}
+	if want := []string{"0002_x", "0100_c", "9999_a", "10000_b"}; !slices.Equal(ids, want) {
+		t.Errorf("listAppliedMigrations = %q, want %q", ids, want)
+	}
+
+	tests := []struct {
+		limit, offset int
+		want          []string
+	}{
+		{1, 0, []string{"10000_b"}},
+		{2, 1, []string{"0100_c", "9999_a"}},
+		{0, 2, []string{"0002_x", "0100_c"}},
+		{10, 3, []string{"0002_x"}},
+		{1, 5, nil},
+	}
+	for _, tt := range tests {
+		recent, total, err := listRecentMigrations(db, table, tt.limit, tt.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, m := range recent {
+			ids = append(ids, m.id)
+		}
+		if !slices.Equal(ids, tt.want) || total != 4 {
+			t.Errorf("listRecentMigrations(%d, %d) = %q, %d, want %q, 4", tt.limit, tt.offset, ids, total, tt.want)
+		}
+	}
+}
+
+func TestNoTransactionResumes(t *testing.T) {
+	db, src := openFixture(t, map[string]string{
+		"0001_a.up.sql":   "-- fly:no-transaction\nCREATE TABLE a (x INTEGER);\nINSERT INTO b VALUES (1);\nCREATE TABLE c (x INTEGER);",
+		"0001_a.down.sql": "DROP TABLE c;\nDROP TABLE a;",
+	})
+	const table = "fly_migration"
+	ctx := context.Background()
+	fsys := os.DirFS(src)
+	if err := initMigrationTable(db, table); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := up(ctx, db, fsys, table, 0); err == nil {
+		t.Fatal("up succeeded with a statement on a missing table")
+	}
+	var pos int
+	if err := db.QueryRow("SELECT position FROM fly_migration_progress WHERE id = '0001_a'").Scan(&pos); err != nil || pos != 1 {
+		t.Fatalf("progress = %d (%v), want 1", pos, err)
+	}
+	if got := registered(t, db, table); len(got) != 0 {
+		t.Errorf("migration table holds %q after the failure, want nothing", got)
+	}
+
+	// The first statement is not run again: it would fail on the existing table.
+	if _, err := db.Exec("CREATE TABLE b (x INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := up(ctx, db, fsys, table, 0); err != nil {
+		t.Fatalf("up after the fix: %v", err)
+	}
+	if got, want := registered(t, db, table), []string{"0001_a"}; !slices.Equal(got, want) {
+		t.Errorf("migration table holds %q, want %q", got, want)
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM fly_migration_progress").Scan(&n); err != nil || n != 0 {
+		t.Errorf("progress table holds %d rows (%v), want 0", n, err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// noTransaction reports whether the up script of the migration has the
+// fly:no-transaction directive, for statements that cannot run in a
+// transaction block such as CREATE INDEX CONCURRENTLY.
+func noTransaction(fsys fs.FS, migration string) (bool, error) {
+	script, err := fs.ReadFile(fsys, migration+".up.sql")
+	if err != nil {
+		return false, err
+	}
+	_, ok := directives(string(script))["no-transaction"]
+	return ok, nil
+}
+
+// initProgressTable ensures that the table recording the progress of
+// migrations that run outside of a transaction is present.
+func initProgressTable(conn *sql.Conn, table string) error {
+	_, err := conn.ExecContext(context.Background(), "CREATE TABLE IF NOT EXISTS "+progressTable(table)+" (id VARCHAR(256) PRIMARY KEY, position BIGINT NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("could not create migration progress table: %v", err)
+	}
+	return nil
+}
+
+// readProgress returns the position recorded for the migration, and whether there is one.
+func readProgress(conn *sql.Conn, table, migration string) (int64, bool, error) {
+	var pos int64
+	err := conn.QueryRowContext(context.Background(), sqlDialect().bind("SELECT position FROM "+progressTable(table)+" WHERE id = $1"), migration).Scan(&pos)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("could not read progress of %s: %v", migration, err)
+	}
+	return pos, true, nil
+}
+
+// execer is implemented by *sql.Conn and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// saveProgress records the position reached by the migration.
+func saveProgress(conn execer, table, migration string, pos int64) error {
+	d := sqlDialect()
+	query := d.upsert("INSERT INTO "+progressTable(table)+" (id, position) VALUES ($1, $2)", "id", "position")
+	_, err := conn.ExecContext(context.Background(), d.bind(query), migration, pos)
+	if err != nil {
+		return fmt.Errorf("could not save progress of %s: %v", migration, err)
+	}
+	return nil
+}
+
+// applyWithoutTx runs the up script of the migration one statement at a time,
+// each committed on its own. The number of statements that succeeded is
+// checkpointed, so that running up again after a failure resumes from the
+// failed statement instead of repeating the ones that already took effect.
+func applyWithoutTx(ctx context.Context, db *sql.DB, fsys fs.FS, table, migration string) error {
+	start := time.Now()
+	filename := migration + ".up.sql"
+	script, err := readScript(fsys, filename)
+	if err != nil {
+		return err
+	}
+	stmts := splitStatements(string(script))
+
+	// Session settings such as the role must hold for every statement.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := initProgressTable(conn, table); err != nil {
+		return err
+	}
+	done, _, err := readProgress(conn, table, migration)
+	if err != nil {
+		return err
+	}
+	if done > 0 {
+		log.Printf("resuming %s after statement %d of %d", migration, done, len(stmts))
+	}
+
+	role := *execRole
+	if r, ok := directives(string(script))["role"]; ok {
+		role = r
+	}
+
+	for i := done; i < int64(len(stmts)); i++ {
+		verbosef("%s: statement %d, committed on its own:\n%s", filename, i+1, stmts[i])
+		if err := execAsRole(ctx, conn, role, stmts[i]); err != nil {
+			return fmt.Errorf("could not run %s: statement %d: %v", filename, i+1, err)
+		}
+		if err := saveProgress(conn, table, migration, i+1); err != nil {
+			return err
+		}
+	}
+
+	return finishProgress(conn, fsys, table, migration, time.Since(start))
+}
+
+// execAsRole runs a statement on conn as the given role, if any. The role is
+// only set for the statement: the progress bookkeeping runs as the connecting
+// user, and the connection goes back to the pool without it.
+func execAsRole(ctx context.Context, conn *sql.Conn, role, stmt string) error {
+	if role == "" {
+		_, err := conn.ExecContext(ctx, stmt)
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "SET ROLE "+pq.QuoteIdentifier(role)); err != nil {
+		return fmt.Errorf("could not set role %s: %v", role, err)
+	}
+	_, err := conn.ExecContext(ctx, stmt)
+	// Not ctx: the role must be reset after a cancellation too.
+	if _, resetErr := conn.ExecContext(context.Background(), "RESET ROLE"); resetErr != nil {
+		return errors.Join(err, fmt.Errorf("could not reset role: %v", resetErr))
+	}
+	return err
+}
+
+// finishProgress registers a migration that ran in steps and clears its
+// progress. Elapsed is how long the last run took.
+func finishProgress(conn *sql.Conn, fsys fs.FS, table, migration string, elapsed time.Duration) error {
+	sum, err := migrationChecksum(fsys, migration)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := registerMigration(tx, table, migration, sum, elapsed); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sqlDialect().bind("DELETE FROM "+progressTable(table)+" WHERE id = $1"), migration); err != nil {
+		return fmt.Errorf("could not clear progress of %s: %v", migration, err)
+	}
+	return tx.Commit()
+}
+
+// doRepair runs the down script of a migration that is not recorded as
+// applied, to clean up what a fly:no-transaction migration left behind when it
+// failed half way, and forgets its progress so that the next up starts it
+// over. As fly cannot tell what the down script will find, it must be
+// confirmed with -yes.
+func doRepair(db *sql.DB) error {
+	id := flag.Arg(1)
+	if id == "" {
+		return errors.New("usage: fly repair -yes <id>")
+	}
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	table := *migrationTable
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(migrations, id) {
+		return fmt.Errorf("unknown migration %s", id)
+	}
+	if err := checkDownFiles(fsys, []string{id}); err != nil {
+		return err
+	}
+
+	release, err := migrationLock(context.Background(), db, table)
+	if err != nil {
+		return err
+	}
+	defer release()
+	applied, err := isMigrationApplied(db, table, id)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return fmt.Errorf("migration %s is applied: roll it back with down", id)
+	}
+	log.Printf("WARNING: running the down script of %s, which is NOT recorded as applied", id)
+	if !*yes {
+		return errors.New("repair not confirmed (use -yes)")
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := initProgressTable(conn, table); err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = step("down", id, func() error { return runScript(ctx, tx, fsys, id+".down.sql") })
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sqlDialect().bind("DELETE FROM "+progressTable(table)+" WHERE id = $1"), id); err != nil {
+		return fmt.Errorf("could not clear progress of %s: %v", id, err)
+	}
+	return tx.Commit()
+}
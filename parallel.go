@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+var parallel = flag.Int("parallel", 1, "number of migrations up may apply at once, on separate connections, following their fly:requires directives")
+
+// dependencies returns, for each pending migration, the pending migrations it
+// must wait for. A migration with the fly:requires directive waits for the
+// migrations it lists, which must be applied or pending. Any other migration
+// waits for all the pending migrations before it, as when applying in order.
+// Migrations that wait for each other, directly or not, are refused.
+func dependencies(fsys fs.FS, applied, pending []string) (map[string][]string, error) {
+	deps := make(map[string][]string)
+	for i, id := range pending {
+		script, err := fs.ReadFile(fsys, id+".up.sql")
+		if err != nil {
+			return nil, err
+		}
+		requires, ok := directives(string(script))["requires"]
+		if !ok {
+			deps[id] = pending[:i]
+			continue
+		}
+		deps[id] = []string{}
+		for _, req := range strings.FieldsFunc(requires, func(r rune) bool { return r == ',' || r == ' ' }) {
+			switch {
+			case slices.Contains(pending, req):
+				deps[id] = append(deps[id], req)
+			case !slices.Contains(applied, req):
+				return nil, fmt.Errorf("migration %s requires %s, which is neither applied nor pending", id, req)
+			}
+		}
+	}
+
+	// Take away the migrations that could run, as long as there are some:
+	// the ones left wait for each other.
+	left := slices.Clone(pending)
+	for len(left) > 0 {
+		var next []string
+		for _, id := range left {
+			if slices.ContainsFunc(deps[id], func(dep string) bool { return slices.Contains(left, dep) }) {
+				next = append(next, id)
+			}
+		}
+		if len(next) == len(left) {
+			return nil, fmt.Errorf("migrations %s require each other", strings.Join(left, ", "))
+		}
+		left = next
+	}
+	return deps, nil
+}
+
+// upParallel applies the pending migrations, each in its own transaction, with
+// up to -parallel of them running at once. A migration starts once the
+// migrations it depends on are applied. After a failure no new migration is
+// started, and the error is returned when the running ones are done.
+func upParallel(ctx context.Context, db *sql.DB, fsys fs.FS, table string, pending []string) error {
+	applied, err := listAppliedMigrations(db, table)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, m := range applied {
+		ids = append(ids, m.id)
+	}
+	deps, err := dependencies(fsys, ids, pending)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		id  string
+		err error
+	}
+	var (
+		results  = make(chan result)
+		done     = make(map[string]bool)
+		started  = make(map[string]bool)
+		running  = 0
+		firstErr error
+	)
+	ready := func(id string) bool {
+		for _, dep := range deps[id] {
+			if !done[dep] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		for _, id := range pending {
+			if firstErr != nil || running == *parallel {
+				break
+			}
+			if started[id] || !ready(id) {
+				continue
+			}
+			started[id] = true
+			running++
+			go func() {
+				results <- result{id, applyOne(ctx, db, fsys, table, id)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		if r.err != nil && firstErr == nil {
+			firstErr = r.err
+		}
+		done[r.id] = r.err == nil
+	}
+
+	return firstErr
+}
+
+// applyOne applies a single migration in a transaction of its own, or
+// statement by statement if it has the fly:no-transaction directive, or batch
+// by batch if it has the batch directives.
+func applyOne(ctx context.Context, db *sql.DB, fsys fs.FS, table, id string) error {
+	noTx, err := noTransaction(fsys, id)
+	if err != nil {
+		return err
+	}
+	if noTx {
+		return step("up", id, func() error { return applyWithoutTx(ctx, db, fsys, table, id) })
+	}
+	b, batched, err := batchOf(fsys, id)
+	if err != nil {
+		return err
+	}
+	if batched {
+		return step("up", id, func() error { return applyBatched(ctx, db, fsys, table, id, b) })
+	}
+	isolation, err := migrationIsolation(fsys, []string{id})
+	if err != nil {
+		return err
+	}
+	return step("up", id, func() error {
+		verbosef("begin transaction for %s", id)
+		tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: isolation})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := applyInTx(ctx, tx, fsys, table, id); err != nil {
+			return err
+		}
+		verbosef("commit %s", id)
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		scripts map[string]string
+		applied []string
+		want    map[string][]string
+		err     string
+	}{
+		{
+			name:    "in order",
+			scripts: map[string]string{"0001_a": "", "0002_b": "", "0003_c": ""},
+			want:    map[string][]string{"0001_a": {}, "0002_b": {"0001_a"}, "0003_c": {"0001_a", "0002_b"}},
+		},
+		{
+			name: "requires",
+			scripts: map[string]string{
+				"0001_a": "",
+				"0002_b": "-- fly:requires 0001_a",
+				"0003_c": "-- fly:requires 0001_a",
+				"0004_d": "-- fly:requires 0002_b, 0003_c",
+			},
+			want: map[string][]string{"0001_a": {}, "0002_b": {"0001_a"}, "0003_c": {"0001_a"}, "0004_d": {"0002_b", "0003_c"}},
+		},
+		{
+			name:    "requires nothing",
+			scripts: map[string]string{"0001_a": "", "0002_b": "-- fly:requires"},
+			want:    map[string][]string{"0001_a": {}, "0002_b": {}},
+		},
+		{
+			name:    "requires applied",
+			scripts: map[string]string{"0002_b": "-- fly:requires 0001_a", "0003_c": "-- fly:requires 0001_a 0002_b"},
+			applied: []string{"0001_a"},
+			want:    map[string][]string{"0002_b": {}, "0003_c": {"0002_b"}},
+		},
+		{
+			name:    "requires a later migration",
+			scripts: map[string]string{"0001_a": "-- fly:requires 0002_b", "0002_b": "-- fly:requires"},
+			want:    map[string][]string{"0001_a": {"0002_b"}, "0002_b": {}},
+		},
+		{
+			name:    "unknown requirement",
+			scripts: map[string]string{"0001_a": "", "0002_b": "-- fly:requires 0000_x"},
+			err:     "migration 0002_b requires 0000_x, which is neither applied nor pending",
+		},
+		{
+			name:    "requires itself",
+			scripts: map[string]string{"0001_a": "", "0002_b": "-- fly:requires 0002_b"},
+			err:     "migrations 0002_b require each other",
+		},
+		{
+			name:    "cycle",
+			scripts: map[string]string{"0001_a": "-- fly:requires 0002_b", "0002_b": "-- fly:requires 0001_a", "0003_c": ""},
+			err:     "migrations 0001_a, 0002_b, 0003_c require each other",
+		},
+		{
+			name:    "cycle through an ordered migration",
+			scripts: map[string]string{"0001_a": "", "0002_b": "-- fly:requires 0003_c", "0003_c": ""},
+			err:     "migrations 0002_b, 0003_c require each other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for id, script := range tt.scripts {
+				fsys[id+".up.sql"] = &fstest.MapFile{Data: []byte(script + "\nSELECT 1;\n")}
+			}
+			pending := slices.Sorted(maps.Keys(tt.scripts))
+
+			deps, err := dependencies(fsys, tt.applied, pending)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("dependencies = %v, want error %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.EqualFunc(deps, tt.want, slices.Equal) {
+				t.Errorf("dependencies = %q, want %q", deps, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+)
+
+var tryDDL = flag.Bool("try-ddl", false, "make check-perms create and drop a table in a rolled-back transaction")
+
+// privilegeCheck is a privilege and the query that tells whether the role has it.
+type privilegeCheck struct {
+	what, query string
+}
+
+// doCheckPerms reports whether the connected role has the privileges that fly
+// needs, before a migration fails half-way for the lack of one. Nothing is
+// changed: -try-ddl runs its DDL in a transaction that is rolled back.
+func doCheckPerms(db *sql.DB) error {
+	var role, schema string
+	if err := db.QueryRow("SELECT current_user, current_schema()").Scan(&role, &schema); err != nil {
+		return fmt.Errorf("could not connect: %v", err)
+	}
+	fmt.Printf("role %s, schema %s\n", role, schema)
+
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", *migrationTable).Scan(&exists); err != nil {
+		return err
+	}
+	checks := []privilegeCheck{
+		{"CREATE on schema " + schema, "SELECT has_schema_privilege(current_schema(), 'CREATE')"},
+	}
+	if exists {
+		for _, p := range []string{"SELECT", "INSERT", "UPDATE", "DELETE"} {
+			checks = append(checks, privilegeCheck{
+				p + " on table " + *migrationTable,
+				"SELECT has_table_privilege('" + *migrationTable + "', '" + p + "')",
+			})
+		}
+	}
+
+	missing := 0
+	for _, c := range checks {
+		var ok bool
+		if err := db.QueryRow(c.query).Scan(&ok); err != nil {
+			return fmt.Errorf("could not check %s: %v", c.what, err)
+		}
+		printCheck(c.what, ok)
+		if !ok {
+			missing++
+		}
+	}
+	if !exists {
+		fmt.Printf("table %s does not exist yet: init will create it\n", *migrationTable)
+	}
+
+	if *tryDDL {
+		err := probeDDL(db)
+		printCheck("DDL in a transaction", err == nil)
+		if err != nil {
+			fmt.Printf("\t%v\n", err)
+			missing++
+		}
+	}
+
+	if missing > 0 {
+		return fmt.Errorf("%d privilege(s) missing", missing)
+	}
+	return nil
+}
+
+func printCheck(what string, ok bool) {
+	state := "ok"
+	if !ok {
+		state = "missing"
+	}
+	fmt.Printf("%-8s%s\n", state, what)
+}
+
+// probeDDL creates, alters and drops a table in a transaction that is rolled back.
+func probeDDL(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		"CREATE TABLE fly_check_perms (id int)",
+		"ALTER TABLE fly_check_perms ADD COLUMN name text",
+		"DROP TABLE fly_check_perms",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
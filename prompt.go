@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// interactive reports whether fly can ask questions: stdin is a terminal.
+func interactive() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks a yes/no question on the terminal. Anything but yes means no.
+// It gives up with the error of ctx when ctx is cancelled, as commands that
+// catch Ctrl-C to roll back would otherwise not hear it during the question.
+func confirm(ctx context.Context, question string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	type reply struct {
+		answer string
+		err    error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		answer, err := stdin.ReadString('\n')
+		replies <- reply{answer, err}
+	}()
+	var answer string
+	select {
+	case r := <-replies:
+		if r.err != nil && r.answer == "" {
+			return false, r.err
+		}
+		answer = r.answer
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return false, ctx.Err()
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var desiredSchema = flag.String("desired", "", "SQL `file` describing the desired schema, for diff-gen")
+
+// column describes a table column.
+type column struct {
+	name     string
+	dataType string
+	notNull  bool
+}
+
+func (c column) definition() string {
+	def := pq.QuoteIdentifier(c.name) + " " + c.dataType
+	if c.notNull {
+		def += " NOT NULL"
+	}
+	return def
+}
+
+// schema maps the tables of a database schema to their columns, in order.
+type schema map[string][]column
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// introspectSchema reads the tables and columns of the current schema from
+// information_schema. The tables fly uses for bookkeeping are left out.
+func introspectSchema(q querier) (schema, error) {
+	rows, err := q.Query(`SELECT c.table_name, c.column_name, c.data_type, c.udt_name, c.character_maximum_length, c.numeric_precision, c.numeric_scale, c.is_nullable
+		FROM information_schema.columns c
+		JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+		WHERE c.table_schema = current_schema() AND t.table_type = 'BASE TABLE'
+		ORDER BY c.table_name, c.ordinal_position`)
+	if err != nil {
+		return nil, fmt.Errorf("could not read schema: %v", err)
+	}
+	defer rows.Close()
+
+	_, name := splitTable(*migrationTable)
+	seed := seedTable(*migrationTable)
+	if _, s, ok := strings.Cut(seed, "."); ok {
+		seed = s
+	}
+	bookkeeping := []string{name, name + "_progress", seed}
+
+	s := make(schema)
+	for rows.Next() {
+		var (
+			table, dataType, udtName, nullable string
+			col                                column
+			length, precision, scale           sql.NullInt64
+		)
+		if err := rows.Scan(&table, &col.name, &dataType, &udtName, &length, &precision, &scale, &nullable); err != nil {
+			return nil, err
+		}
+		if slices.Contains(bookkeeping, table) {
+			continue
+		}
+		switch {
+		case dataType == "USER-DEFINED":
+			col.dataType = udtName
+		case dataType == "ARRAY":
+			col.dataType = strings.TrimPrefix(udtName, "_") + "[]"
+		case length.Valid:
+			col.dataType = fmt.Sprintf("%s(%d)", dataType, length.Int64)
+		case dataType == "numeric" && precision.Valid:
+			col.dataType = fmt.Sprintf("numeric(%d,%d)", precision.Int64, scale.Int64)
+		default:
+			col.dataType = dataType
+		}
+		col.notNull = nullable == "NO"
+		s[table] = append(s[table], col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// diffSchemas returns the statements that turn schema from into schema to,
+// and the statements that revert them. Only tables and columns are compared.
+func diffSchemas(from, to schema) (up, down []string) {
+	var tables []string
+	for t := range from {
+		tables = append(tables, t)
+	}
+	for t := range to {
+		if _, ok := from[t]; !ok {
+			tables = append(tables, t)
+		}
+	}
+	sort.Strings(tables)
+
+	for _, t := range tables {
+		oldCols, inFrom := from[t]
+		newCols, inTo := to[t]
+		table := pq.QuoteIdentifier(t)
+		switch {
+		case !inFrom:
+			up = append(up, createTable(t, newCols))
+			down = append(down, "DROP TABLE "+table+";")
+		case !inTo:
+			up = append(up, "DROP TABLE "+table+";")
+			down = append(down, createTable(t, oldCols))
+		default:
+			for _, c := range newCols {
+				i := slices.IndexFunc(oldCols, func(o column) bool { return o.name == c.name })
+				switch {
+				case i < 0:
+					up = append(up, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", table, c.definition()))
+					down = append(down, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s;", table, pq.QuoteIdentifier(c.name)))
+				case oldCols[i].dataType != c.dataType:
+					up = append(up, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s;", table, pq.QuoteIdentifier(c.name), c.dataType))
+					down = append(down, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s;", table, pq.QuoteIdentifier(c.name), oldCols[i].dataType))
+				}
+			}
+			for _, c := range oldCols {
+				if !slices.ContainsFunc(newCols, func(n column) bool { return n.name == c.name }) {
+					up = append(up, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s;", table, pq.QuoteIdentifier(c.name)))
+					down = append(down, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", table, c.definition()))
+				}
+			}
+		}
+	}
+
+	slices.Reverse(down)
+	return up, down
+}
+
+func createTable(name string, cols []column) string {
+	defs := make([]string, len(cols))
+	for i, c := range cols {
+		defs[i] = "\t" + c.definition()
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n%s\n);", pq.QuoteIdentifier(name), strings.Join(defs, ",\n"))
+}
+
+// desiredState loads the desired schema file into a transaction on the shadow
+// database and reads the schema it produces. The transaction is rolled back.
+func desiredState(filename string) (schema, error) {
+	script, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	db, err := connect(*shadowDSN)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(string(script)); err != nil {
+		return nil, fmt.Errorf("could not load %s: %v", filename, err)
+	}
+	return introspectSchema(tx)
+}
+
+func doDiffGen(db *sql.DB) error {
+	if *desiredSchema == "" || *shadowDSN == "" {
+		return errors.New("diff-gen requires -desired and -shadow-dsn")
+	}
+
+	want, err := desiredState(*desiredSchema)
+	if err != nil {
+		return err
+	}
+	have, err := introspectSchema(db)
+	if err != nil {
+		return err
+	}
+
+	up, down := diffSchemas(have, want)
+	if len(up) == 0 {
+		fmt.Println("schema is up to date")
+		return nil
+	}
+
+	label := flag.Arg(1)
+	if label == "" {
+		label = "schema_diff"
+	}
+	id, err := createMigration(label, []byte(strings.Join(up, "\n")+"\n"), []byte(strings.Join(down, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println("new", id)
+	return nil
+}
+
+// snapshot is the shape of a schema, as far as the reversibility test is concerned.
+type snapshot struct {
+	tables  schema
+	indexes map[string]string // definitions by index name
+}
+
+func takeSnapshot(q querier) (snapshot, error) {
+	tables, err := introspectSchema(q)
+	if err != nil {
+		return snapshot{}, err
+	}
+	rows, err := q.Query("SELECT indexname, indexdef FROM pg_indexes WHERE schemaname = current_schema()")
+	if err != nil {
+		return snapshot{}, fmt.Errorf("could not read indexes: %v", err)
+	}
+	defer rows.Close()
+	indexes := make(map[string]string)
+	for rows.Next() {
+		var name, def string
+		if err := rows.Scan(&name, &def); err != nil {
+			return snapshot{}, err
+		}
+		indexes[name] = def
+	}
+	if err := rows.Err(); err != nil {
+		return snapshot{}, err
+	}
+	return snapshot{tables, indexes}, nil
+}
+
+// compareSnapshots describes how after differs from before.
+func compareSnapshots(before, after snapshot) []string {
+	var diffs []string
+	for t, cols := range after.tables {
+		old, ok := before.tables[t]
+		if !ok {
+			diffs = append(diffs, "table "+t+" is left behind")
+			continue
+		}
+		for _, c := range cols {
+			i := slices.IndexFunc(old, func(o column) bool { return o.name == c.name })
+			switch {
+			case i < 0:
+				diffs = append(diffs, "column "+t+"."+c.name+" is left behind")
+			case old[i] != c:
+				diffs = append(diffs, fmt.Sprintf("column %s.%s changed from %s to %s", t, c.name, old[i].definition(), c.definition()))
+			}
+		}
+		for _, c := range old {
+			if !slices.ContainsFunc(cols, func(n column) bool { return n.name == c.name }) {
+				diffs = append(diffs, "column "+t+"."+c.name+" is gone")
+			}
+		}
+	}
+	for t := range before.tables {
+		if _, ok := after.tables[t]; !ok {
+			diffs = append(diffs, "table "+t+" is gone")
+		}
+	}
+	for name, def := range after.indexes {
+		old, ok := before.indexes[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, "index "+name+" is left behind")
+		case old != def:
+			diffs = append(diffs, "index "+name+" changed")
+		}
+	}
+	for name := range before.indexes {
+		if _, ok := after.indexes[name]; !ok {
+			diffs = append(diffs, "index "+name+" is gone")
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+func doTestReversible() error {
+	target := flag.Arg(1)
+	if target == "" {
+		return errors.New("usage: fly test-reversible <id>")
+	}
+	if *shadowDSN == "" {
+		return errors.New("test-reversible requires -shadow-dsn")
+	}
+
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+	i := slices.Index(migrations, target)
+	if i < 0 {
+		return fmt.Errorf("unknown migration %s", target)
+	}
+
+	db, err := connect(*shadowDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Everything happens in this transaction, so the shadow database is left as it was found.
+	defer tx.Rollback()
+
+	for _, id := range migrations[:i] {
+		if err := runScript(context.Background(), tx, fsys, id+".up.sql"); err != nil {
+			return fmt.Errorf("up %s: %v", id, err)
+		}
+	}
+	before, err := takeSnapshot(tx)
+	if err != nil {
+		return err
+	}
+	if err := runScript(context.Background(), tx, fsys, target+".up.sql"); err != nil {
+		return fmt.Errorf("up %s: %v", target, err)
+	}
+	if err := runScript(context.Background(), tx, fsys, target+".down.sql"); err != nil {
+		return fmt.Errorf("down %s: %v", target, err)
+	}
+	after, err := takeSnapshot(tx)
+	if err != nil {
+		return err
+	}
+
+	diffs := compareSnapshots(before, after)
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("down script of %s does not fully reverse its up script", target)
+	}
+	fmt.Println("reversible", target)
+	return nil
+}
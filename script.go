@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// readScript reads a script to be executed. A leading UTF-8 byte order mark,
+// which some editors add and Postgres rejects, is dropped. Scripts that are
+// not valid UTF-8 are run as they are, with a warning, since the error
+// Postgres reports for them rarely points at the encoding. With -expand-env,
+// environment variables are expanded.
+func readScript(fsys fs.FS, filename string) ([]byte, error) {
+	script, err := fs.ReadFile(fsys, filename)
+	if err != nil {
+		return nil, err
+	}
+	script = bytes.TrimPrefix(script, utf8BOM)
+	if !utf8.Valid(script) {
+		log.Printf("warning: %s is not valid UTF-8", filename)
+	}
+	if *expandEnv {
+		expanded, err := expandVars(string(script))
+		if err != nil {
+			return nil, fmt.Errorf("could not expand %s: %v", filename, err)
+		}
+		script = []byte(expanded)
+	}
+	return script, nil
+}
+
+var varPattern = regexp.MustCompile(`^\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+
+// expandVars replaces the ${VAR} and $VAR references of script with the
+// values of the environment variables, which must be set. Comments, string
+// literals, quoted identifiers, dollar-quoted blocks, positional parameters
+// like $1 and dollar signs inside identifiers are left alone.
+func expandVars(script string) (string, error) {
+	masked := maskSQL(script)
+	var b strings.Builder
+	for i := 0; i < len(script); {
+		if masked[i] != '$' || i > 0 && isIdentByte(script[i-1]) {
+			b.WriteByte(script[i])
+			i++
+			continue
+		}
+		m := varPattern.FindStringSubmatch(script[i:])
+		if m == nil {
+			b.WriteByte('$')
+			i++
+			continue
+		}
+		name := m[1] + m[2]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(value)
+		i += len(m[0])
+	}
+	return b.String(), nil
+}
+
+// maskSQL returns a copy of script in which comments, string literals, quoted
+// identifiers and dollar-quoted blocks are replaced by spaces, so that the
+// remaining text can be searched for keywords and statement separators.
+// Offsets in the result match offsets in script.
+func maskSQL(script string) string {
+	b := []byte(script)
+	blank := func(i, j int) {
+		for k := i; k < j; k++ {
+			if b[k] != '\n' {
+				b[k] = ' '
+			}
+		}
+	}
+
+	for i := 0; i < len(script); {
+		j := i + 1
+		switch {
+		case strings.HasPrefix(script[i:], "--"):
+			j = len(script)
+			if k := strings.IndexByte(script[i:], '\n'); k >= 0 {
+				j = i + k
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			j = len(script)
+			if k := strings.Index(script[i+2:], "*/"); k >= 0 {
+				j = i + 2 + k + 2
+			}
+		case script[i] == '\'' || script[i] == '"':
+			j = quotedEnd(script, i, *driver == "mysql" || escapeString(script, i))
+		case script[i] == '$':
+			tag := dollarTag(script, i)
+			if tag == "" {
+				i++
+				continue
+			}
+			j = len(script)
+			if k := strings.Index(script[i+len(tag):], tag); k >= 0 {
+				j = i + len(tag) + k + len(tag)
+			}
+		default:
+			i++
+			continue
+		}
+		blank(i, j)
+		i = j
+	}
+
+	return string(b)
+}
+
+// quotedEnd returns the offset just past the quoted literal starting at i.
+// A doubled quote character inside the literal is an escaped quote, and so is
+// one preceded by a backslash when backslash is set.
+func quotedEnd(script string, i int, backslash bool) int {
+	q := script[i]
+	for j := i + 1; j < len(script); j++ {
+		if backslash && script[j] == '\\' {
+			j++
+			continue
+		}
+		if script[j] != q {
+			continue
+		}
+		if j+1 < len(script) && script[j+1] == q {
+			j++
+			continue
+		}
+		return j + 1
+	}
+	return len(script)
+}
+
+// escapeString reports whether the quote at offset i starts a Postgres escape
+// string constant such as E'it\'s', in which backslashes escape.
+func escapeString(script string, i int) bool {
+	return script[i] == '\'' && i > 0 && (script[i-1] == 'E' || script[i-1] == 'e') &&
+		(i == 1 || !isIdentByte(script[i-2]))
+}
+
+// dollarTag returns the dollar-quote delimiter (such as "$$" or "$body$") that
+// starts at offset i, or the empty string if there is none. Positional
+// parameters like $1 are not delimiters.
+func dollarTag(script string, i int) string {
+	if i > 0 && isIdentByte(script[i-1]) {
+		return ""
+	}
+	for j := i + 1; j < len(script); j++ {
+		c := script[j]
+		switch {
+		case c == '$':
+			return script[i : j+1]
+		case j == i+1 && c >= '0' && c <= '9':
+			return ""
+		case !isIdentByte(c):
+			return ""
+		}
+	}
+	return ""
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// splitStatements splits script into its individual statements. Semicolons
+// inside comments, literals and dollar-quoted blocks do not end a statement.
+// Statements that contain nothing but whitespace and comments are dropped.
+func splitStatements(script string) []string {
+	masked := maskSQL(script)
+
+	var stmts []string
+	start := 0
+	for i := 0; i <= len(masked); i++ {
+		if i < len(masked) && masked[i] != ';' {
+			continue
+		}
+		if strings.TrimSpace(masked[start:i]) != "" {
+			stmts = append(stmts, strings.TrimSpace(script[start:i]))
+		}
+		start = i + 1
+	}
+	return stmts
+}
+
+// directives returns the "-- fly:<name> <value>" comments found at the top of
+// the script, before its first statement, by name. A colon may follow the name.
+func directives(script string) map[string]string {
+	d := make(map[string]string)
+	script = strings.TrimPrefix(script, string(utf8BOM))
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		comment, ok := strings.CutPrefix(line, "--")
+		if !ok {
+			break
+		}
+		directive, ok := strings.CutPrefix(strings.TrimSpace(comment), "fly:")
+		if !ok {
+			continue
+		}
+		name, value, _ := strings.Cut(directive, " ")
+		name, hasColon := strings.CutSuffix(name, ":")
+		value = strings.TrimSpace(value)
+		if !hasColon {
+			value = strings.TrimSpace(strings.TrimPrefix(value, ":"))
+		}
+		d[name] = value
+	}
+	return d
+}
+
+var ddlPattern = regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP)\b`)
+
+// findDDL returns the statements of script that look like schema changes.
+// It is a heuristic: only the leading keyword of each statement is inspected.
+func findDDL(script string) []string {
+	var found []string
+	for _, stmt := range splitStatements(script) {
+		if ddlPattern.MatchString(maskSQL(stmt)) {
+			found = append(found, stmt)
+		}
+	}
+	return found
+}
+
+var (
+	dropTablePattern  = regexp.MustCompile(`(?i)\bDROP\s+TABLE\b`)
+	dropColumnPattern = regexp.MustCompile(`(?i)\bDROP\s+COLUMN\b`)
+	truncatePattern   = regexp.MustCompile(`(?i)^\s*TRUNCATE\b`)
+	deletePattern     = regexp.MustCompile(`(?i)^\s*DELETE\b`)
+	wherePattern      = regexp.MustCompile(`(?i)\bWHERE\b`)
+)
+
+// findDestructive returns a description of every statement of script that
+// looks like it destroys data. Like findDDL it is a heuristic over the text of
+// the statements, ignoring comments and literals.
+func findDestructive(script string) []string {
+	var found []string
+	for _, stmt := range splitStatements(script) {
+		code := maskSQL(stmt)
+		switch {
+		case dropTablePattern.MatchString(code):
+			found = append(found, "DROP TABLE")
+		case dropColumnPattern.MatchString(code):
+			found = append(found, "DROP COLUMN")
+		case truncatePattern.MatchString(code):
+			found = append(found, "TRUNCATE")
+		case deletePattern.MatchString(code) && !wherePattern.MatchString(code):
+			found = append(found, "DELETE without WHERE")
+		}
+	}
+	return found
+}
+
+var (
+	dropPattern       = regexp.MustCompile(`(?i)\bDROP\s+(\w+)`)
+	renamePattern     = regexp.MustCompile(`(?i)\bRENAME\b`)
+	alterTypePattern  = regexp.MustCompile(`(?i)\bALTER\s+(COLUMN\s+)?\S+\s+(SET\s+DATA\s+)?TYPE\b`)
+	setNotNullPattern = regexp.MustCompile(`(?i)\bSET\s+NOT\s+NULL\b`)
+	addColumnPattern  = regexp.MustCompile(`(?i)\bADD\s+(COLUMN\s+)?(IF\s+NOT\s+EXISTS\s+)?\S+(\([^)]*\)|[^,(])*`)
+	notNullPattern    = regexp.MustCompile(`(?i)\bNOT\s+NULL\b`)
+	defaultPattern    = regexp.MustCompile(`(?i)\bDEFAULT\b`)
+	constraintPattern = regexp.MustCompile(`(?i)^ADD\s+(CONSTRAINT|PRIMARY|UNIQUE|CHECK|FOREIGN|EXCLUDE)\b`)
+)
+
+// findContracting returns a description of every operation of script that is
+// not additive: one that code written for the schema before the migration may
+// trip over. These are drops, renames, column type changes, SET NOT NULL and
+// NOT NULL columns added without a default. Like findDestructive it is a
+// heuristic over the text of the statements.
+func findContracting(script string) []string {
+	var found []string
+	for _, stmt := range splitStatements(script) {
+		code := maskSQL(stmt)
+		for _, m := range dropPattern.FindAllStringSubmatch(code, -1) {
+			found = append(found, "DROP "+strings.ToUpper(m[1]))
+		}
+		if renamePattern.MatchString(code) {
+			found = append(found, "RENAME")
+		}
+		if alterTypePattern.MatchString(code) {
+			found = append(found, "column type change")
+		}
+		if setNotNullPattern.MatchString(code) {
+			found = append(found, "SET NOT NULL")
+		}
+		for _, add := range addColumnPattern.FindAllString(code, -1) {
+			if !constraintPattern.MatchString(add) && notNullPattern.MatchString(add) && !defaultPattern.MatchString(add) {
+				found = append(found, "NOT NULL column without default")
+			}
+		}
+	}
+	return found
+}
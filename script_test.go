@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		script string
+		want   []string
+	}{
+		{"plain", "postgres", "CREATE TABLE a (x int); DROP TABLE b;", []string{"CREATE TABLE a (x int)", "DROP TABLE b"}},
+		{"trailing statement", "postgres", "SELECT 1;\nSELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"empty statements", "postgres", ";\n-- only a comment;\n;", nil},
+		{"doubled quote", "postgres", "SELECT 'it''s; x'; SELECT 2", []string{"SELECT 'it''s; x'", "SELECT 2"}},
+		{"quoted identifier", "postgres", `SELECT "a;b" FROM t; SELECT 2`, []string{`SELECT "a;b" FROM t`, "SELECT 2"}},
+		{"line comment", "postgres", "SELECT 1 -- a; b\n; SELECT 2", []string{"SELECT 1 -- a; b", "SELECT 2"}},
+		{"block comment", "postgres", "SELECT /* a; b */ 1; SELECT 2", []string{"SELECT /* a; b */ 1", "SELECT 2"}},
+		{"dollar quote", "postgres", "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT 2",
+			[]string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT 2"}},
+		{"tagged dollar quote", "postgres", "DO $body$ BEGIN PERFORM 1; END $body$; SELECT 2", []string{"DO $body$ BEGIN PERFORM 1; END $body$", "SELECT 2"}},
+		{"positional parameter", "postgres", "UPDATE t SET x = $1; SELECT 2", []string{"UPDATE t SET x = $1", "SELECT 2"}},
+		{"escape string", "postgres", `SELECT E'it\'s; x'; SELECT 2`, []string{`SELECT E'it\'s; x'`, "SELECT 2"}},
+		{"lowercase escape string", "postgres", `SELECT e'a\\'; SELECT 2`, []string{`SELECT e'a\\'`, "SELECT 2"}},
+		{"backslash in standard string", "postgres", `SELECT 'a\'; SELECT 2`, []string{`SELECT 'a\'`, "SELECT 2"}},
+		{"identifier ending in e", "postgres", `SELECT name'a\'; SELECT 2`, []string{`SELECT name'a\'`, "SELECT 2"}},
+		{"mysql backslash escape", "mysql", `INSERT INTO t VALUES ('it\'s; x'); SELECT 2`, []string{`INSERT INTO t VALUES ('it\'s; x')`, "SELECT 2"}},
+		{"mysql double-quoted string", "mysql", `SELECT "a\"; b"; SELECT 2`, []string{`SELECT "a\"; b"`, "SELECT 2"}},
+		{"mysql escaped backslash", "mysql", `SELECT 'a\\'; SELECT 2`, []string{`SELECT 'a\\'`, "SELECT 2"}},
+	}
+	defer func(d string) { *driver = d }(*driver)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*driver = tt.driver
+			if got := splitStatements(tt.script); !slices.Equal(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	t.Setenv("FLY_TEST_TS", "fast")
+	t.Setenv("FLY_TEST_ROLE", "app")
+	tests := []struct {
+		name, script, want string
+		wantErr            bool
+	}{
+		{"braces", "CREATE TABLE t (x int) TABLESPACE ${FLY_TEST_TS};", "CREATE TABLE t (x int) TABLESPACE fast;", false},
+		{"bare", "GRANT SELECT ON t TO $FLY_TEST_ROLE;", "GRANT SELECT ON t TO app;", false},
+		{"unset", "GRANT SELECT ON t TO $FLY_TEST_UNSET;", "", true},
+		{"line comment", "-- see $FLY_TEST_UNSET\nSELECT 1;", "-- see $FLY_TEST_UNSET\nSELECT 1;", false},
+		{"block comment", "/* ${FLY_TEST_UNSET} */ SELECT 1;", "/* ${FLY_TEST_UNSET} */ SELECT 1;", false},
+		{"string literal", "SELECT '$FLY_TEST_UNSET';", "SELECT '$FLY_TEST_UNSET';", false},
+		{"dollar quote", "DO $$ BEGIN RAISE NOTICE '$FLY_TEST_UNSET'; END $$;", "DO $$ BEGIN RAISE NOTICE '$FLY_TEST_UNSET'; END $$;", false},
+		{"positional parameter", "UPDATE t SET x = $1;", "UPDATE t SET x = $1;", false},
+		{"inside identifier", "SELECT a$FLY_TEST_UNSET FROM t;", "SELECT a$FLY_TEST_UNSET FROM t;", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandVars(tt.script)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandVars(%q) error = %v, want error %v", tt.script, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expandVars(%q) = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptible returns a context that is cancelled when fly receives SIGINT
+// or SIGTERM, so that the statement in progress is aborted and its
+// transaction rolled back, and the function that stops listening for them.
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// interrupted reports err, the failure of a command run with ctx, as an
+// interruption if ctx was cancelled by a signal.
+func interrupted(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return &exitError{130, "interrupted, rolled back"}
+	}
+	return err
+}
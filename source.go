@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// source caches the file system returned by migrationFS.
+var source fs.FS
+
+// embedded holds the migrations compiled into fly with -tags embed, if any.
+var embedded fs.FS
+
+// useEmbedded reports whether migrations are read from the ones compiled into
+// fly: they are unless -source or -sourcedir is given.
+func useEmbedded() bool {
+	return embedded != nil && *sourceArchive == "" && !isFlagSet("sourcedir")
+}
+
+// migrationFS returns the file system that migration files are read from: the
+// -source archive when one is given, the migrations compiled into fly when
+// there are some and -sourcedir is not given, the -sourcedir directory
+// otherwise.
+func migrationFS() (fs.FS, error) {
+	if source != nil {
+		return source, nil
+	}
+	if useEmbedded() {
+		source = embedded
+		return source, nil
+	}
+	if *sourceArchive == "" {
+		// The directory is often a symlink in monorepos: diagnostics
+		// name the directory it resolves to.
+		dir, err := filepath.EvalSymlinks(*sourcedir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("source directory %s does not exist: create the first migration with fly new, or give the directory with -sourcedir (%w)", *sourcedir, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve source directory: %w", err)
+		}
+		source = dirFS{os.DirFS(dir), dir}
+		return source, nil
+	}
+	fsys, err := openTarFS(*sourceArchive)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", *sourceArchive, err)
+	}
+	source = fsys
+	return source, nil
+}
+
+// dirFS is a directory file system whose errors carry the full path of the file.
+type dirFS struct {
+	fsys fs.FS
+	dir  string
+}
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	f, err := d.fsys.Open(name)
+	return f, d.fullPath(err)
+}
+
+func (d dirFS) ReadFile(name string) ([]byte, error) {
+	data, err := fs.ReadFile(d.fsys, name)
+	return data, d.fullPath(err)
+}
+
+func (d dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(d.fsys, name)
+	return entries, d.fullPath(err)
+}
+
+func (d dirFS) fullPath(err error) error {
+	var perr *fs.PathError
+	if errors.As(err, &perr) {
+		perr.Path = filepath.Join(d.dir, perr.Path)
+	}
+	return err
+}
+
+// tarFS is a read-only file system holding the regular files of a tar archive.
+// Directories inside the archive are flattened: files are known by their base
+// name, which must be unique in the archive.
+type tarFS map[string][]byte
+
+// openTarFS loads the tar archive with the given name, which may be gzip-compressed.
+func openTarFS(name string) (tarFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	fsys := make(tarFS)
+	paths := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		base := path.Base(hdr.Name)
+		if other, ok := paths[base]; ok {
+			return nil, fmt.Errorf("%s and %s have the same name", other, hdr.Name)
+		}
+		paths[base] = hdr.Name
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		fsys[base] = data
+	}
+	return fsys, nil
+}
+
+func (fsys tarFS) Open(name string) (fs.File, error) {
+	if name == "." {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &tarDir{entries: entries}, nil
+	}
+	data, ok := fsys[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &tarFile{Reader: bytes.NewReader(data), info: tarFileInfo{name, int64(len(data))}}, nil
+}
+
+func (fsys tarFS) ReadFile(name string) ([]byte, error) {
+	data, ok := fsys[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return bytes.Clone(data), nil
+}
+
+func (fsys tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries []fs.DirEntry
+	for name, data := range fsys {
+		entries = append(entries, fs.FileInfoToDirEntry(tarFileInfo{name, int64(len(data))}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+type tarFile struct {
+	*bytes.Reader
+	info tarFileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Close() error               { return nil }
+
+type tarDir struct {
+	entries []fs.DirEntry
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return tarFileInfo{".", 0}, nil }
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: fs.ErrInvalid}
+}
+func (d *tarDir) Close() error { return nil }
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type tarFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi tarFileInfo) Name() string       { return fi.name }
+func (fi tarFileInfo) Size() int64        { return fi.size }
+func (fi tarFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi tarFileInfo) IsDir() bool        { return fi.name == "." }
+func (fi tarFileInfo) Sys() any           { return nil }
+
+func (fi tarFileInfo) Mode() fs.FileMode {
+	if fi.IsDir() {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+// writeTar writes a tar archive holding the given entries, gzip-compressed if
+// asked, and returns its name. Names ending with a slash are directories.
+func writeTar(t *testing.T, gz bool, entries []tarEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if gz {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data = zbuf.Bytes()
+	}
+	name := filepath.Join(t.TempDir(), "migrations.tar")
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+type tarEntry struct {
+	name, data, link string
+}
+
+func TestTarFS(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		files   map[string]string
+	}{
+		{
+			name: "flat",
+			entries: []tarEntry{
+				{name: "0001_a.up.sql", data: "CREATE TABLE a (x int);"},
+				{name: "0001_a.down.sql", data: "DROP TABLE a;"},
+			},
+			files: map[string]string{"0001_a.up.sql": "CREATE TABLE a (x int);", "0001_a.down.sql": "DROP TABLE a;"},
+		},
+		{
+			name: "nested",
+			entries: []tarEntry{
+				{name: "./"},
+				{name: "./db/"},
+				{name: "./db/migrations/"},
+				{name: "./db/migrations/0001_a.up.sql", data: "up"},
+				{name: "db/migrations/0001_a.down.sql", data: "down"},
+			},
+			files: map[string]string{"0001_a.up.sql": "up", "0001_a.down.sql": "down"},
+		},
+		{
+			name: "other files",
+			entries: []tarEntry{
+				{name: "migrations/README.md", data: "# Migrations"},
+				{name: "migrations/0001_a.up.sql", data: "up"},
+				{name: "migrations/latest.sql", link: "0001_a.up.sql"},
+				{name: "migrations/seeds/"},
+				{name: "migrations/seeds/users.sql", data: "INSERT"},
+			},
+			files: map[string]string{"README.md": "# Migrations", "0001_a.up.sql": "up", "users.sql": "INSERT"},
+		},
+		{
+			name:  "empty",
+			files: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		for _, gz := range []bool{false, true} {
+			name := tt.name
+			if gz {
+				name += " gzip"
+			}
+			t.Run(name, func(t *testing.T) {
+				fsys, err := openTarFS(writeTar(t, gz, tt.entries))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var want []string
+				for name, data := range tt.files {
+					want = append(want, name)
+					got, err := fs.ReadFile(fsys, name)
+					if err != nil {
+						t.Errorf("ReadFile(%s): %v", name, err)
+					} else if string(got) != data {
+						t.Errorf("ReadFile(%s) = %q, want %q", name, got, data)
+					}
+				}
+				slices.Sort(want)
+				if err := fstest.TestFS(fsys, want...); err != nil {
+					t.Error(err)
+				}
+
+				entries, err := fs.ReadDir(fsys, ".")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, e := range entries {
+					names = append(names, e.Name())
+				}
+				if !slices.Equal(names, want) {
+					t.Errorf("ReadDir = %q, want %q", names, want)
+				}
+				if _, err := fs.ReadFile(fsys, "migrations/0001_a.up.sql"); err == nil {
+					t.Error("ReadFile found a file by its path in the archive, want only its base name")
+				}
+			})
+		}
+	}
+}
+
+func TestTarFSMigrations(t *testing.T) {
+	fsys, err := openTarFS(writeTar(t, true, []tarEntry{
+		{name: "app/migrations/0002_b.up.sql", data: "up"},
+		{name: "app/migrations/0002_b.down.sql", data: "down"},
+		{name: "app/migrations/0001_a.up.sql", data: "up"},
+		{name: "app/migrations/notes.txt", data: "notes"},
+		{name: "app/migrations/.0003_c.up.sql.swp", data: "swap"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := listDirMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0001_a", "0002_b"}; !slices.Equal(ids, want) {
+		t.Errorf("listDirMigrations = %q, want %q", ids, want)
+	}
+}
+
+func TestTarFSDuplicate(t *testing.T) {
+	_, err := openTarFS(writeTar(t, false, []tarEntry{
+		{name: "a/0001_a.up.sql", data: "one"},
+		{name: "b/0001_a.up.sql", data: "two"},
+	}))
+	if err == nil {
+		t.Error("openTarFS accepted two files with the same base name")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+)
+
+var (
+	schemaPattern = flag.String("schemas", "", "apply migrations to every schema matching the `pattern` (* matches any sequence), each with its own migration table")
+	failFast      = flag.Bool("fail-fast", false, "stop at the first schema that fails to migrate")
+)
+
+// listSchemas returns the names of the schemas matching pattern, in which *
+// stands for any sequence of characters.
+func listSchemas(db *sql.DB, pattern string) ([]string, error) {
+	like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `*`, `%`).Replace(pattern)
+	rows, err := db.Query("SELECT schema_name FROM information_schema.schemata WHERE schema_name LIKE $1 ORDER BY schema_name", like)
+	if err != nil {
+		return nil, fmt.Errorf("could not list schemas: %v", err)
+	}
+	defer rows.Close()
+
+	var schemas []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return schemas, nil
+}
+
+// upSchemas applies the first n pending migrations, or all of them when n is
+// 0, to every schema matching pattern. Unless -fail-fast is set, a failing
+// schema does not stop the others.
+func upSchemas(ctx context.Context, db *sql.DB, fsys fs.FS, table, pattern string, n int) error {
+	schemas, err := listSchemas(db, pattern)
+	if err != nil {
+		return err
+	}
+	if len(schemas) == 0 {
+		return fmt.Errorf("no schema matches %s", pattern)
+	}
+
+	var failed []string
+	for _, schema := range schemas {
+		fmt.Println("schema", schema)
+		if err := upSchema(ctx, fsys, table, schema, n); err != nil {
+			if *failFast || ctx.Err() != nil {
+				return fmt.Errorf("schema %s: %v", schema, err)
+			}
+			log.Printf("schema %s: %v", schema, err)
+			failed = append(failed, schema)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d schemas failed: %s", len(failed), len(schemas), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func upSchema(ctx context.Context, fsys fs.FS, table, schema string, n int) error {
+	db, err := openSchemaDB(schema)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	release, err := migrationLock(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := initMigrationTable(db, table); err != nil {
+		return err
+	}
+	return up(ctx, db, fsys, table, n)
+}
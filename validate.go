@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// doValidate checks the migration files without connecting to the database:
+// every migration has an up and a down script with statements, every down
+// script belongs to a migration and, with the serial ID format, serials are
+// unique and follow each other without gaps.
+func doValidate() error {
+	fsys, err := migrationFS()
+	if err != nil {
+		return err
+	}
+	migrations, err := listDirMigrations(fsys)
+	if err != nil {
+		return err
+	}
+
+	problems, err := irreversible(fsys, migrations)
+	if err != nil {
+		return err
+	}
+	for _, id := range migrations {
+		script, err := fs.ReadFile(fsys, id+".up.sql")
+		if err != nil {
+			return err
+		}
+		if len(splitStatements(string(script))) == 0 {
+			problems = append(problems, id+".up.sql is empty")
+		}
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".down.sql")
+		if ok && !slices.Contains(migrations, id) {
+			problems = append(problems, e.Name()+" has no up script")
+		}
+	}
+
+	if *idFormat == "serial" {
+		serialProblems, err := checkSerials(migrations)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, serialProblems...)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found", len(problems))
+	}
+	return nil
+}
+
+// checkSerials describes the serials of the migrations that are used more
+// than once or skipped.
+func checkSerials(migrations []string) ([]string, error) {
+	re, err := idPattern()
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	bySerial := make(map[uint64][]string)
+	var serials []uint64
+	for _, id := range migrations {
+		_, s, _, _ := splitID(re, id)
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid serial %q", id, s))
+			continue
+		}
+		if len(bySerial[n]) == 0 {
+			serials = append(serials, n)
+		}
+		bySerial[n] = append(bySerial[n], id)
+	}
+	slices.Sort(serials)
+	for i, n := range serials {
+		if ids := bySerial[n]; len(ids) > 1 {
+			problems = append(problems, fmt.Sprintf("serial %d is used by %s", n, strings.Join(ids, ", ")))
+		}
+		switch {
+		case i == 0 || n == serials[i-1]+1:
+		case n == serials[i-1]+2:
+			problems = append(problems, fmt.Sprintf("serial %d is missing", n-1))
+		default:
+			problems = append(problems, fmt.Sprintf("serials %d to %d are missing", serials[i-1]+1, n-1))
+		}
+	}
+	return problems, nil
+}